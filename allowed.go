@@ -1,15 +1,14 @@
 package main
 
 import (
+	"context"
 	"time"
 
 	"github.com/jmoiron/sqlx/types"
-	"github.com/kr/pretty"
-	"github.com/lib/pq"
 	"github.com/rs/zerolog"
 )
 
-func onAllowed(logger zerolog.Logger, token string, wh Webhook) {
+func onAllowed(ctx context.Context, logger zerolog.Logger, token string, wh Webhook) {
 	b := wh.Action.Data.Board.Id
 
 	switch wh.Action.Type {
@@ -21,30 +20,57 @@ func onAllowed(logger zerolog.Logger, token string, wh Webhook) {
 			time.Sleep(time.Second * 2)
 		} else if wh.Action.Type == "convertToCardFromCheckItem" {
 			// we must proceed as if deleting the checkItem here
-			checkItemId, err := itemJustConvertedIntoCard(
+			checkItemId, err := itemJustConvertedIntoCard(ctx,
 				wh.Action.Data.Card.Name,
 				wh.Action.Data.Checklist.Id,
 			)
 			if err == nil {
 				wh.Action.Type = "deleteCheckItem"
 				wh.Action.Data.CheckItem.Id = checkItemId
-				onAllowed(logger, token, wh)
+				onAllowed(ctx, logger, token, wh)
 			}
 		}
 
-		saveBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card)
-	case "deleteCard", "moveCardFromBoard":
+		if wh.Action.Type != "moveCardToBoard" {
+			// remember who created the card, they'll be able to edit it
+			wh.Action.Data.Card.IdMemberCreator = wh.Action.MemberCreator.Id
+		}
+
+		// keep its members so we can tell who could edit it before each
+		// change. new cards have none (unless they come from the initial
+		// backup, which has them all), but copied or moved ones may have.
+		card := wh.Action.Data.Card
+		if wh.Action.Type == "copyCard" || wh.Action.Type == "moveCardToBoard" {
+			plaintoken, err := openToken(token)
+			if err == nil {
+				card.IdMembers, err = cardMembers(ctx,
+					makeLoggedTrelloClient(ctx, logger, plaintoken), card.Id)
+			}
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed to fetch card members")
+				saveBackupData(ctx, b, card.Id, card)
+				break
+			}
+		}
+		saveBackupData(ctx, b, card.Id, cardBackupData(card))
+	case "deleteCard":
+		// keep the backup so the card can be restored later, see deleted.go
+		_, err = pg.Exec(`
+UPDATE backups SET deleted_at = now(), deleted_by = $3
+WHERE id = $1 AND board = $2
+        `, wh.Action.Data.Card.Id, b, wh.Action.MemberCreator.Username)
+	case "moveCardFromBoard":
 		// delete card, checklists and checkItems
 		var card Card
-		fetchBackupData(wh.Action.Data.Card.Id, &card)
+		fetchBackupData(ctx, wh.Action.Data.Card.Id, &card)
 		for _, idChecklist := range card.IdChecklists {
 			var checklist Checklist
-			fetchBackupData(idChecklist, &checklist)
+			fetchBackupData(ctx, idChecklist, &checklist)
 			for _, idCheckItem := range checklist.IdCheckItems {
-				deleteBackupData(b, idCheckItem)
+				deleteBackupData(ctx, b, idCheckItem)
 			}
 		}
-		deleteBackupData(b, wh.Action.Data.Card.Id)
+		deleteBackupData(ctx, b, wh.Action.Data.Card.Id)
 	case "updateCard":
 		var cardValues types.JSONText
 		cardValues, err = toJSONText(wh.Action.Data.Card)
@@ -52,87 +78,96 @@ func onAllowed(logger zerolog.Logger, token string, wh Webhook) {
 			break
 		}
 
-		err = saveBackupData(b, wh.Action.Data.Card.Id, cardValues)
+		err = saveBackupData(ctx, b, wh.Action.Data.Card.Id, cardValues)
 	case "addMemberToCard":
-		err = updateBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
+		invalidateCardMembers(wh.Action.Data.Card.Id)
+		// here and below, ids are removed before being appended so they
+		// aren't added twice when actions are backed up again (like when
+		// the initial backup runs again)
+		err = updateBackupData(ctx, b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
 			`'{"idMembers": []}'::jsonb || $init || data`,
-			`jsonb_set(data, '{idMembers}', (data->'idMembers') || $arg)`,
+			`jsonb_set(data, '{idMembers}', ((data->'idMembers') - ($arg::jsonb#>>'{}')) || $arg)`,
 			wh.Action.Data.IdMember,
 		)
 	case "removeMemberFromCard":
-		err = updateBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
+		invalidateCardMembers(wh.Action.Data.Card.Id)
+		err = updateBackupData(ctx, b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
 			`'{"idMembers": []}'::jsonb || $init || data`,
 			`jsonb_set(data, '{idMembers}', (data->'idMembers') - ($arg::jsonb#>>'{}'))`,
 			wh.Action.Data.IdMember,
 		)
 	case "addLabelToCard":
-		go saveBackupData(b, wh.Action.Data.Label.Id, wh.Action.Data.Label)
+		wh.Action.Data.Label.IdBoard = b
+		go saveBackupData(ctx, b, wh.Action.Data.Label.Id, wh.Action.Data.Label)
 
-		err = updateBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
+		err = updateBackupData(ctx, b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
 			`'{"idLabels": []}'::jsonb || $init || data`,
-			`jsonb_set(data, '{idLabels}', (data->'idLabels') || $arg)`,
+			`jsonb_set(data, '{idLabels}', ((data->'idLabels') - ($arg::jsonb#>>'{}')) || $arg)`,
 			wh.Action.Data.Label.Id,
 		)
 	case "removeLabelFromCard":
-		go saveBackupData(b, wh.Action.Data.Label.Id, wh.Action.Data.Label)
+		wh.Action.Data.Label.IdBoard = b
+		go saveBackupData(ctx, b, wh.Action.Data.Label.Id, wh.Action.Data.Label)
 
-		err = updateBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
+		err = updateBackupData(ctx, b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
 			`'{"idLabels": []}'::jsonb || $init || data`,
 			`jsonb_set(data, '{idLabels}', (data->'idLabels') - ($arg::jsonb#>>'{}'))`,
 			wh.Action.Data.Label.Id,
 		)
 	case "createLabel", "updateLabel":
-		err = saveBackupData(b, wh.Action.Data.Label.Id, wh.Action.Data.Label)
+		wh.Action.Data.Label.IdBoard = b
+		err = saveBackupData(ctx, b, wh.Action.Data.Label.Id, wh.Action.Data.Label)
 	case "deleteLabel":
-		err = deleteBackupData(b, wh.Action.Data.Label.Id)
+		err = deleteBackupData(ctx, b, wh.Action.Data.Label.Id)
 	case "addChecklistToCard":
 		// create checklist on database
-		go saveBackupData(b, wh.Action.Data.Checklist.Id, wh.Action.Data.Checklist)
+		go saveBackupData(ctx, b, wh.Action.Data.Checklist.Id, wh.Action.Data.Checklist)
 
 		// update card
-		err = updateBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
+		err = updateBackupData(ctx, b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
 			`'{"idChecklists": []}'::jsonb || $init || data`,
-			`jsonb_set(data, '{idChecklists}', (data->'idChecklists') || $arg)`,
+			`jsonb_set(data, '{idChecklists}', ((data->'idChecklists') - ($arg::jsonb#>>'{}')) || $arg)`,
 			wh.Action.Data.Checklist.Id,
 		)
 	case "updateChecklist":
-		err = saveBackupData(b, wh.Action.Data.Checklist.Id, wh.Action.Data.Checklist)
+		err = saveBackupData(ctx, b, wh.Action.Data.Checklist.Id, wh.Action.Data.Checklist)
 	case "removeChecklistFromCard":
 		// delete checkItems and checklist
 		var checklist Checklist
-		fetchBackupData(wh.Action.Data.Checklist.Id, &checklist)
+		fetchBackupData(ctx, wh.Action.Data.Checklist.Id, &checklist)
 		for _, idCheckItem := range checklist.IdCheckItems {
-			err = deleteBackupData(b, idCheckItem)
+			err = deleteBackupData(ctx, b, idCheckItem)
 			if err != nil {
-				pretty.Log(err)
+				withPqFields(logger.Warn().Err(err), err).Str("checkItem", idCheckItem).
+					Msg("failed to delete checkItem backup")
 			}
 		}
-		go deleteBackupData(b, wh.Action.Data.Checklist.Id)
+		go deleteBackupData(ctx, b, wh.Action.Data.Checklist.Id)
 
 		// update card
-		err = updateBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
+		err = updateBackupData(ctx, b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
 			`'{"idChecklists": []}'::jsonb || $init || data`,
 			`jsonb_set(data, '{idChecklists}', (data->'idChecklists') - ($arg::jsonb#>>'{}'))`,
 			wh.Action.Data.Checklist.Id,
 		)
 	case "createCheckItem":
 		// create checkItem on database
-		go saveBackupData(b, wh.Action.Data.CheckItem.Id, wh.Action.Data.CheckItem)
+		go saveBackupData(ctx, b, wh.Action.Data.CheckItem.Id, wh.Action.Data.CheckItem)
 
 		// update checklist
-		err = updateBackupData(b, wh.Action.Data.Checklist.Id, wh.Action.Data.Checklist,
+		err = updateBackupData(ctx, b, wh.Action.Data.Checklist.Id, wh.Action.Data.Checklist,
 			`'{"idCheckItems": []}'::jsonb || $init || data`,
-			`jsonb_set(data, '{idCheckItems}', (data->'idCheckItems') || $arg)`,
+			`jsonb_set(data, '{idCheckItems}', ((data->'idCheckItems') - ($arg::jsonb#>>'{}')) || $arg)`,
 			wh.Action.Data.CheckItem.Id,
 		)
 	case "updateCheckItem", "updateCheckItemStateOnCard":
-		err = saveBackupData(b, wh.Action.Data.CheckItem.Id, wh.Action.Data.CheckItem)
+		err = saveBackupData(ctx, b, wh.Action.Data.CheckItem.Id, wh.Action.Data.CheckItem)
 	case "deleteCheckItem":
 		// delete checkItem
-		deleteBackupData(b, wh.Action.Data.CheckItem.Id)
+		deleteBackupData(ctx, b, wh.Action.Data.CheckItem.Id)
 
 		// update checklist
-		err = updateBackupData(b, wh.Action.Data.Checklist.Id, wh.Action.Data.Checklist,
+		err = updateBackupData(ctx, b, wh.Action.Data.Checklist.Id, wh.Action.Data.Checklist,
 			`'{"idCheckItems": []}'::jsonb || $init || data`,
 			`jsonb_set(data, '{idCheckItems}', (data->'idCheckItems') - ($arg::jsonb#>>'{}'))`,
 			wh.Action.Data.CheckItem.Id,
@@ -160,30 +195,63 @@ func onAllowed(logger zerolog.Logger, token string, wh Webhook) {
 			Date:     wh.Action.Date,
 		}
 
-		err = updateBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
+		err = updateBackupData(ctx, b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
 			`'{"comments": []}'::jsonb || $init || data`,
-			`jsonb_set(data, '{comments}', (data->'comments') || $arg)`,
+			`jsonb_set(data, '{comments}', coalesce((
+			  SELECT jsonb_agg(c) FROM jsonb_array_elements(data->'comments') AS c
+			  WHERE c->>'id' != $arg::jsonb->>'id'
+			), '[]') || $arg)`,
 			comment)
+	case "updateBoard":
+		// the board on these webhooks only has the fields that were changed
+		board := map[string]interface{}{
+			"name":      wh.Action.Data.Board.Name,
+			"shortLink": wh.Action.Data.Board.ShortLink,
+		}
+		changed := map[string]interface{}{
+			"closed": wh.Action.Data.Board.Closed,
+			"prefs":  wh.Action.Data.Board.Prefs,
+		}
+		if wh.Action.Data.Board.Name != "" {
+			changed["name"] = wh.Action.Data.Board.Name
+		}
+
+		err = updateBackupData(ctx, b, b, board,
+			`'{"prefs": {}}'::jsonb || $init || data`,
+			`jsonb_set(data || ($arg - 'prefs'), '{prefs}', (data->'prefs') || ($arg->'prefs'))`,
+			changed,
+		)
+	case "addMemberToBoard", "removeMemberFromBoard",
+		"makeAdminOfBoard", "makeNormalMemberOfBoard", "makeObserverOfBoard":
+		invalidateBoardMemberships(b)
+
+		// keep a copy of the memberships so unallowed changes can be reverted
+		var plaintoken string
+		plaintoken, err = openToken(token)
+		if err != nil {
+			break
+		}
+		err = backupBoardMemberships(ctx, makeLoggedTrelloClient(ctx, logger, plaintoken), b)
 	case "addAttachmentToCard":
 		if attachmentIsUploaded(wh.Action.Data.Attachment) {
 			// this file was uploaded on Trello, we must save a
 			// secondary copy (on s3, same path)
-			err = saveToS3(wh.Action.Data.Attachment.Id, wh.Action.Data.Attachment.Url)
+			err = saveToS3(ctx, wh.Action.Data.Attachment.Id, wh.Action.Data.Attachment.Url)
 			if err != nil {
 				break
 			}
 		}
 
-		go saveBackupData(b, wh.Action.Data.Attachment.Id, wh.Action.Data.Attachment)
-		err = updateBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
+		go saveBackupData(ctx, b, wh.Action.Data.Attachment.Id, wh.Action.Data.Attachment)
+		err = updateBackupData(ctx, b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
 			`'{"idAttachments": []}'::jsonb || $init || data`,
-			`jsonb_set(data, '{idAttachments}', (data->'idAttachments') || $arg)`,
+			`jsonb_set(data, '{idAttachments}', ((data->'idAttachments') - ($arg::jsonb#>>'{}')) || $arg)`,
 			wh.Action.Data.Attachment.Id)
 	case "deleteAttachmentFromCard":
-		go deleteBackupData(b, wh.Action.Data.Attachment.Id)
-		go deleteFromS3(wh.Action.Data.Attachment.Id)
+		go deleteBackupData(ctx, b, wh.Action.Data.Attachment.Id)
+		go deleteFromS3(ctx, wh.Action.Data.Attachment.Id)
 
-		err = updateBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
+		err = updateBackupData(ctx, b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
 			`'{"idAttachments": []}'::jsonb || $init || data`,
 			`jsonb_set(data, '{idAttachments}', (data->'idAttachments') - ($arg::jsonb#>>'{}'))`,
 			wh.Action.Data.Attachment.Id,
@@ -191,12 +259,7 @@ func onAllowed(logger zerolog.Logger, token string, wh Webhook) {
 	}
 
 	if err != nil {
-		if perr, ok := err.(*pq.Error); ok {
-			pretty.Log(perr)
-		}
-
-		logger.Warn().
-			Err(err).
+		withPqFields(logger.Warn().Err(err), err).
 			Msg("failed to perform action on allowed")
 	}
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// boardView is what the JSON API shows about a board.
+type boardView struct {
+	Id        string         `json:"id"`
+	Name      string         `json:"name"`
+	ShortLink string         `json:"shortLink"`
+	Enabled   bool           `json:"enabled"`
+	Email     string         `json:"email,omitempty"`
+	Degraded  bool           `json:"degraded"`
+	TokenOk   bool           `json:"tokenOk"`
+	WebhookOk bool           `json:"webhookOk"`
+	CheckedAt *time.Time     `json:"checkedAt,omitempty"`
+	Settings  *BoardSettings `json:"settings,omitempty"`
+}
+
+func makeBoardView(board Board) boardView {
+	view := boardView{
+		Id:        board.Id,
+		Name:      board.Name,
+		ShortLink: board.ShortLink,
+		Enabled:   board.Enabled,
+	}
+	if board.Enabled {
+		view.Email = board.Email
+		view.Degraded = board.Degraded
+		view.TokenOk = board.TokenOk
+		view.WebhookOk = board.WebhookOk
+		view.CheckedAt = &board.CheckedAt
+		view.Settings = &board.Settings
+	}
+	return view
+}
+
+func jsonResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func jsonError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{message})
+}
+
+// apiBoard authenticates the request and makes sure the user is an admin of
+// the board in the path.
+func apiBoard(w http.ResponseWriter, r *http.Request) (user authUser, boardId string, ok bool) {
+	user, ok = authenticate(r)
+	if !ok {
+		jsonError(w, "log in or send an api key.", 401)
+		return
+	}
+
+	// the session cookie is sent along with forms posted from other sites
+	if r.Method != "GET" && requestApiKey(r) == "" && !isJSONRequest(r) {
+		jsonError(w, "send the body with Content-Type: application/json.", 415)
+		return user, "", false
+	}
+
+	boardId = mux.Vars(r)["id"]
+	if !isBoardAdmin(r.Context(), makeTrelloClient(user.Token), user.Id, boardId) {
+		jsonError(w, "only board admins can do that.", 403)
+		return user, boardId, false
+	}
+	return
+}
+
+func apiListBoards(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticate(r)
+	if !ok {
+		jsonError(w, "log in or send an api key.", 401)
+		return
+	}
+
+	boards, err := userBoards(user)
+	if err != nil {
+		jsonError(w, "failed to fetch boards: "+err.Error(), 503)
+		return
+	}
+
+	views := make([]boardView, len(boards))
+	for i, board := range boards {
+		views[i] = makeBoardView(board)
+	}
+	jsonResponse(w, views)
+}
+
+// apiSetupBoard enables or disables a board, like /setBoard.
+func apiSetupBoard(w http.ResponseWriter, r *http.Request) {
+	user, boardId, ok := apiBoard(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		jsonError(w, "invalid request: "+err.Error(), 400)
+		return
+	}
+	if body.Enabled == nil {
+		jsonError(w, "missing 'enabled'.", 400)
+		return
+	}
+
+	err = setupBoard(boardId, user.Id, user.Email, user.Token, *body.Enabled)
+	if err != nil {
+		jsonError(w, "failed to set permissions on board: "+err.Error(), 500)
+		return
+	}
+
+	jsonResponse(w, struct {
+		Id      string `json:"id"`
+		Enabled bool   `json:"enabled"`
+	}{boardId, *body.Enabled})
+}
+
+func apiGetSettings(w http.ResponseWriter, r *http.Request) {
+	_, boardId, ok := apiBoard(w, r)
+	if !ok {
+		return
+	}
+
+	var settings BoardSettings
+	err := pg.Get(&settings, `SELECT settings FROM boards WHERE id = $1`, boardId)
+	if err != nil {
+		jsonError(w, "board is not enabled.", 404)
+		return
+	}
+
+	jsonResponse(w, settings)
+}
+
+func apiSetSettings(w http.ResponseWriter, r *http.Request) {
+	_, boardId, ok := apiBoard(w, r)
+	if !ok {
+		return
+	}
+
+	var settings BoardSettings
+	err := json.NewDecoder(r.Body).Decode(&settings)
+	if err != nil {
+		jsonError(w, "invalid settings: "+err.Error(), 400)
+		return
+	}
+
+	err = saveBoardSettings(boardId, settings)
+	if err != nil {
+		jsonError(w, "failed to save settings: "+err.Error(), 400)
+		return
+	}
+
+	jsonResponse(w, settings)
+}
+
+func apiGetBackup(w http.ResponseWriter, r *http.Request) {
+	_, boardId, ok := apiBoard(w, r)
+	if !ok {
+		return
+	}
+
+	var data types.JSONText
+	err := pg.Get(&data, `
+SELECT data FROM backups
+WHERE board = $1 AND id = $2
+    `, boardId, mux.Vars(r)["objectId"])
+	if err != nil {
+		jsonError(w, "object not found on backups.", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func apiRestore(w http.ResponseWriter, r *http.Request) {
+	user, boardId, ok := apiBoard(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Card string `json:"card"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Card == "" {
+		jsonError(w, "send the id of the deleted card as {\"card\": ...}.", 400)
+		return
+	}
+
+	err = restoreCard(boardId, body.Card, user.Username)
+	if err != nil {
+		jsonError(w, "failed to restore card: "+err.Error(), 400)
+		return
+	}
+
+	jsonResponse(w, struct {
+		Restored string `json:"restored"`
+	}{body.Card})
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// decided approvals are kept for this long, and pending ones for twice that
+const APPROVALSRETENTION = time.Hour * 24 * 30
+
+type Approval struct {
+	Id        int            `db:"id"`
+	Board     string         `db:"board"`
+	Webhook   types.JSONText `db:"webhook"`
+	Status    string         `db:"status"` // "pending", "approved" or "denied"
+	CreatedAt time.Time      `db:"created_at"`
+	DecidedBy string         `db:"decided_by"`
+}
+
+// actions we know how to perform again after they were reverted.
+var replayableActions = map[string]bool{
+	"createCard":                 true,
+	"updateCard":                 true,
+	"commentCard":                true,
+	"addMemberToCard":            true,
+	"removeMemberFromCard":       true,
+	"addLabelToCard":             true,
+	"removeLabelFromCard":        true,
+	"addChecklistToCard":         true,
+	"updateChecklist":            true,
+	"createCheckItem":            true,
+	"updateCheckItem":            true,
+	"updateCheckItemStateOnCard": true,
+	"addAttachmentToCard":        true,
+	"createLabel":                true,
+	"updateLabel":                true,
+	"createList":                 true,
+	"updateList":                 true,
+	"updateBoard":                true,
+	"addMemberToBoard":           true,
+	"removeMemberFromBoard":      true,
+	"makeAdminOfBoard":           true,
+	"makeNormalMemberOfBoard":    true,
+	"makeObserverOfBoard":        true,
+}
+
+// requestApproval stores a reverted action so board admins can approve it
+// later, and lets them know about it.
+func requestApproval(boardId string, wh Webhook) (err error) {
+	v, err := toJSONText(wh)
+	if err != nil {
+		return
+	}
+
+	var emails []string
+	err = pg.Select(&emails, `
+WITH
+req AS (
+  INSERT INTO approvals (board, webhook) VALUES ($1, $2)
+)
+SELECT email FROM boards WHERE id = $1
+UNION
+SELECT email FROM tokens WHERE board = $1
+    `, boardId, v)
+	if err != nil {
+		return
+	}
+
+	return sendEmail(emails,
+		wh.Action.MemberCreator.Username+" is waiting for your approval on Trello",
+		`Hello,
+
+`+wh.Action.MemberCreator.Username+` wanted to `+describeAction(wh)+`,
+but wasn't allowed to, so the change was reverted.
+
+You can approve it (and we'll do it again) or deny it at `+s.Host+`/approvals
+`)
+}
+
+// replayAction performs again an action that was reverted, using the values
+// it had set.
+func replayAction(trello trelloClient, wh Webhook) (err error) {
+	d := wh.Action.Data
+
+	switch wh.Action.Type {
+	case "createCard":
+		err = trello("post", "/1/cards", Card{
+			Name:   d.Card.Name,
+			Desc:   d.Card.Desc,
+			IdList: d.List.Id,
+		}, nil)
+	case "updateCard":
+		err = trello("put", "/1/cards/"+d.Card.Id, changedValues(d.Card, d.Old), nil)
+	case "commentCard":
+		err = trello("post", "/1/cards/"+d.Card.Id+"/actions/comments", Comment{
+			Text: fmt.Sprintf("_[%s](https://trello.com/%s) wrote:_\n\n> %s",
+				wh.Action.MemberCreator.Username, wh.Action.MemberCreator.Id,
+				strings.Join(strings.Split(d.Text, "\n"), "\n> ")),
+		}, nil)
+	case "addMemberToCard":
+		err = trello("post", "/1/cards/"+d.Card.Id+"/idMembers", Value{d.IdMember}, nil)
+	case "removeMemberFromCard":
+		err = trello("delete", "/1/cards/"+d.Card.Id+"/idMembers/"+d.IdMember, nil, nil)
+	case "addLabelToCard":
+		err = trello("post", "/1/cards/"+d.Card.Id+"/idLabels", Value{d.Label.Id}, nil)
+	case "removeLabelFromCard":
+		err = trello("delete", "/1/cards/"+d.Card.Id+"/idLabels/"+d.Label.Id, nil, nil)
+	case "addChecklistToCard":
+		err = trello("post", "/1/cards/"+d.Card.Id+"/checklists", struct {
+			Name string `json:"name"`
+		}{d.Checklist.Name}, nil)
+	case "updateChecklist":
+		err = trello("put", "/1/checklists/"+d.Checklist.Id, changedValues(d.Checklist, d.Old), nil)
+	case "createCheckItem":
+		err = trello("post", "/1/checklists/"+d.Checklist.Id+"/checkItems", CheckItem{
+			Name:    d.CheckItem.Name,
+			Pos:     d.CheckItem.Pos,
+			Checked: d.CheckItem.State == "complete",
+		}, nil)
+	case "updateCheckItem":
+		err = trello("put", "/1/cards/"+d.Card.Id+"/checkItem/"+d.CheckItem.Id,
+			changedValues(d.CheckItem, d.Old), nil)
+	case "updateCheckItemStateOnCard":
+		err = trello("put", "/1/cards/"+d.Card.Id+"/checkItem/"+d.CheckItem.Id, struct {
+			State string `json:"state"`
+		}{d.CheckItem.State}, nil)
+	case "addAttachmentToCard":
+		if attachmentIsUploaded(d.Attachment) {
+			// the file was deleted from trello when we reverted it
+			return errors.New("uploaded files can't be added again")
+		}
+		err = trello("post", "/1/cards/"+d.Card.Id+"/attachments", Attachment{
+			Name: d.Attachment.Name,
+			Url:  d.Attachment.Url,
+		}, nil)
+	case "createLabel":
+		err = trello("post", "/1/labels", Label{
+			Name:    d.Label.Name,
+			Color:   d.Label.Color,
+			IdBoard: d.Board.Id,
+		}, nil)
+	case "updateLabel":
+		err = trello("put", "/1/labels/"+d.Label.Id, changedValues(d.Label, d.Old), nil)
+	case "createList":
+		// it was renamed and archived when reverted
+		err = trello("put", "/1/lists/"+d.List.Id, struct {
+			Name   string `json:"name"`
+			Closed bool   `json:"closed"`
+		}{d.List.Name, false}, nil)
+	case "updateList":
+		err = trello("put", "/1/lists/"+d.List.Id, changedValues(d.List, d.Old), nil)
+	case "updateBoard":
+		data := make(map[string]interface{})
+		for changedKey, changedValue := range changedValues(d.Board, d.Old) {
+			if changedKey != "prefs" {
+				data[changedKey] = changedValue
+			}
+		}
+		if oldPrefs, ok := d.Old["prefs"].(map[string]interface{}); ok {
+			for pref, value := range changedValues(d.Board.Prefs, oldPrefs) {
+				data["prefs/"+pref] = value
+			}
+		}
+		err = trello("put", "/1/boards/"+d.Board.Id, data, nil)
+	case "addMemberToBoard":
+		memberType := d.MemberType
+		if memberType == "" {
+			memberType = "normal"
+		}
+		err = trello("put", "/1/boards/"+d.Board.Id+"/members/"+targetMember(wh), struct {
+			Type string `json:"type"`
+		}{memberType}, nil)
+	case "makeNormalMemberOfBoard":
+		err = trello("put", "/1/boards/"+d.Board.Id+"/members/"+targetMember(wh), struct {
+			Type string `json:"type"`
+		}{"normal"}, nil)
+	case "makeAdminOfBoard":
+		err = trello("put", "/1/boards/"+d.Board.Id+"/members/"+targetMember(wh), struct {
+			Type string `json:"type"`
+		}{"admin"}, nil)
+	case "makeObserverOfBoard":
+		err = trello("put", "/1/boards/"+d.Board.Id+"/members/"+targetMember(wh), struct {
+			Type string `json:"type"`
+		}{"observer"}, nil)
+	case "removeMemberFromBoard":
+		err = trello("delete", "/1/boards/"+d.Board.Id+"/members/"+targetMember(wh), nil, nil)
+	default:
+		err = errors.New("this change can't be performed again")
+	}
+
+	return
+}
+
+// changedValues takes from the updated object the current values of the
+// fields that were changed by an update action.
+func changedValues(object interface{}, old map[string]interface{}) map[string]interface{} {
+	var current map[string]interface{}
+	j, _ := json.Marshal(object)
+	json.Unmarshal(j, &current)
+
+	data := make(map[string]interface{})
+	for changedKey, oldValue := range old {
+		value, ok := current[changedKey]
+		if !ok {
+			// empty values are omitted from our types
+			switch oldValue.(type) {
+			case bool:
+				value = false
+			case float64:
+				value = 0
+			default:
+				value = nil
+			}
+			if changedKey == "desc" || changedKey == "name" {
+				value = ""
+			}
+		}
+		data[changedKey] = value
+	}
+	return data
+}
+
+type approvalView struct {
+	Id          int
+	Board       Board
+	Username    string
+	Description string
+	Date        string
+}
+
+func ServeApprovals(w http.ResponseWriter, r *http.Request) {
+	sess, _ := store.Get(r, "auth-session")
+	username, ok1 := sess.Values["username"]
+	token, ok2 := sess.Values["token"]
+	if !ok1 || !ok2 {
+		http.Redirect(w, r, "/auth", http.StatusFound)
+		return
+	}
+
+	trello := makeTrelloClient(token.(string))
+
+	boards, err := adminBoards(trello, username.(string))
+	if err != nil {
+		http.Error(w, "failed to fetch trello boards: "+err.Error(), 503)
+		return
+	}
+
+	boardids := make([]string, len(boards))
+	for i, board := range boards {
+		boardids[i] = board.Id
+	}
+
+	var approvals []Approval
+	err = pg.Select(&approvals, `
+SELECT * FROM approvals
+WHERE status = 'pending' AND board = ANY (string_to_array($1, ','))
+ORDER BY created_at
+    `, strings.Join(boardids, ","))
+	if err != nil {
+		http.Error(w, "failed to fetch approvals: "+err.Error(), 500)
+		return
+	}
+
+	views := make([]approvalView, 0, len(approvals))
+	for _, approval := range approvals {
+		var wh Webhook
+		approval.Webhook.Unmarshal(&wh)
+
+		view := approvalView{
+			Id:          approval.Id,
+			Username:    wh.Action.MemberCreator.Username,
+			Description: describeAction(wh),
+			Date:        approval.CreatedAt.Format(PRETTYDATEFORMAT),
+		}
+		for _, board := range boards {
+			if board.Id == approval.Board {
+				view.Board = board
+			}
+		}
+		views = append(views, view)
+	}
+
+	err = parsedtemplates.approvals.Execute(w, struct {
+		Username  string
+		Approvals []approvalView
+	}{username.(string), views})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to render /approvals")
+	}
+}
+
+func handleApproval(w http.ResponseWriter, r *http.Request) {
+	sess, _ := store.Get(r, "auth-session")
+	token, ok1 := sess.Values["token"]
+	id, ok2 := sess.Values["id"]
+	if !ok1 || !ok2 {
+		http.Redirect(w, r, "/auth", http.StatusFound)
+		return
+	}
+
+	var approval Approval
+	err := pg.Get(&approval, `
+SELECT * FROM approvals
+WHERE id = $1 AND status = 'pending'
+    `, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "approval not found.", 404)
+		return
+	}
+
+	if !isBoardAdmin(r.Context(), makeTrelloClient(token.(string)), id.(string), approval.Board) {
+		http.Error(w, "only board admins can approve changes.", 403)
+		return
+	}
+
+	status := "denied"
+	if r.FormValue("decision") == "approve" {
+		status = "approved"
+	}
+
+	// claim it before doing anything, so when two admins decide at the same
+	// time the change isn't performed twice
+	err = pg.Get(&approval, `
+UPDATE approvals SET status = $2, decided_by = $3
+WHERE id = $1 AND status = 'pending'
+RETURNING *
+    `, approval.Id, status, id.(string))
+	if err == sql.ErrNoRows {
+		http.Error(w, "this change was already decided by another admin.", 409)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to save decision: "+err.Error(), 500)
+		return
+	}
+
+	if status == "approved" {
+		var wh Webhook
+		err = approval.Webhook.Unmarshal(&wh)
+		if err != nil {
+			releaseApproval(approval.Id)
+			http.Error(w, "invalid stored change: "+err.Error(), 500)
+			return
+		}
+
+		var boardToken string
+		err = pg.Get(&boardToken, `SELECT token FROM boards WHERE id = $1`, approval.Board)
+		if err != nil {
+			releaseApproval(approval.Id)
+			http.Error(w, "board is not enabled anymore.", 400)
+			return
+		}
+		plaintoken, err := openToken(boardToken)
+		if err != nil {
+			releaseApproval(approval.Id)
+			http.Error(w, "failed to decrypt board token: "+err.Error(), 500)
+			return
+		}
+
+		err = replayAction(makeTrelloClient(plaintoken), wh)
+		if err != nil {
+			releaseApproval(approval.Id)
+			http.Error(w, "failed to perform the change: "+err.Error(), 503)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/approvals", http.StatusFound)
+}
+
+// releaseApproval puts back as pending an approval we failed to perform, so
+// it can be approved again later.
+func releaseApproval(approvalId int) {
+	_, err := pg.Exec(`
+UPDATE approvals SET status = 'pending', decided_by = ''
+WHERE id = $1
+    `, approvalId)
+	if err != nil {
+		log.Warn().Err(err).Int("approval", approvalId).Msg("failed to release approval")
+	}
+}
+
+// purgeApprovals deletes old approvals, including the pending ones nobody
+// cared to decide.
+func purgeApprovals() (err error) {
+	_, err = pg.Exec(`
+DELETE FROM approvals
+WHERE created_at < now() - make_interval(secs => $1) * CASE status
+  WHEN 'pending' THEN 2
+  ELSE 1
+END
+    `, APPROVALSRETENTION.Seconds())
+	return
+}
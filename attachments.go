@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
@@ -11,7 +12,10 @@ import (
 	"github.com/minio/minio-go"
 )
 
-func saveToS3(id, trelloURL string) (err error) {
+func saveToS3(ctx context.Context, id, trelloURL string) (err error) {
+	span := s3Span(ctx, "upload", id)
+	defer func() { endSpan(span, err) }()
+
 	// download file from trello
 	file, err := ioutil.TempFile("", "trello-permissions-")
 	if err != nil {
@@ -33,13 +37,17 @@ func saveToS3(id, trelloURL string) (err error) {
 	file.Close()
 
 	// upload to s3
-	_, err = ms3.FPutObject(s.S3BucketName, id, file.Name(),
+	n, err := ms3.FPutObject(s.S3BucketName, id, file.Name(),
 		minio.PutObjectOptions{})
+	s3Bytes.WithLabelValues("upload").Add(float64(n))
 
 	return
 }
 
-func restoreFromS3(attId, attName, cardId, token string) (err error) {
+func restoreFromS3(ctx context.Context, attId, attName, cardId, token string) (err error) {
+	span := s3Span(ctx, "download", attId)
+	defer func() { endSpan(span, err) }()
+
 	file, err := ioutil.TempFile("", "trello-permissions-")
 	if err != nil {
 		return
@@ -64,6 +72,10 @@ func restoreFromS3(attId, attName, cardId, token string) (err error) {
 	}
 	defer file.Close()
 
+	if stat, err := file.Stat(); err == nil {
+		s3Bytes.WithLabelValues("download").Add(float64(stat.Size()))
+	}
+
 	post := &bytes.Buffer{}
 	writer := multipart.NewWriter(post)
 	part, err := writer.CreateFormFile("file", path)
@@ -95,6 +107,9 @@ func restoreFromS3(attId, attName, cardId, token string) (err error) {
 	return
 }
 
-func deleteFromS3(id string) (err error) {
+func deleteFromS3(ctx context.Context, id string) (err error) {
+	span := s3Span(ctx, "delete", id)
+	defer func() { endSpan(span, err) }()
+
 	return ms3.RemoveObject(s.S3BucketName, id)
 }
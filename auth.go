@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// authUser is a Trello user logged in with the auth-session cookie or
+// using one of its API keys.
+type authUser struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Token    string `json:"-"`
+}
+
+type ApiKey struct {
+	Id         int       `db:"id"`
+	Member     string    `db:"member"`
+	Username   string    `db:"username"`
+	Email      string    `db:"email"`
+	Token      string    `db:"token"`
+	KeyHash    string    `db:"key_hash"`
+	Prefix     string    `db:"prefix"`
+	CreatedAt  time.Time `db:"created_at"`
+	LastUsedAt time.Time `db:"last_used_at"`
+}
+
+func authenticate(r *http.Request) (user authUser, ok bool) {
+	if key := requestApiKey(r); key != "" {
+		return authenticateApiKey(key)
+	}
+	return authenticateSession(r)
+}
+
+// requestApiKey is the API key sent on the request, if any.
+func requestApiKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-Api-Key")
+}
+
+// isJSONRequest tells if the request body was sent as JSON, which plain
+// forms on other sites can't do (without a preflight we don't answer).
+func isJSONRequest(r *http.Request) bool {
+	contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	return contentType == "application/json"
+}
+
+// authenticateSession only accepts users logged in with the auth-session
+// cookie, for things API keys shouldn't be able to do.
+func authenticateSession(r *http.Request) (user authUser, ok bool) {
+	sess, _ := store.Get(r, "auth-session")
+	id, ok1 := sess.Values["id"]
+	username, ok2 := sess.Values["username"]
+	email, ok3 := sess.Values["email"]
+	token, ok4 := sess.Values["token"]
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return
+	}
+
+	return authUser{id.(string), username.(string), email.(string), token.(string)}, true
+}
+
+// trelloProfile fetches the user who owns a Trello token.
+func trelloProfile(token string) (user authUser, err error) {
+	err = makeTrelloClient(token)("get", "/1/members/me?fields=username,id,email", nil, &user)
+	user.Token = token
+	return
+}
+
+func authenticateApiKey(key string) (user authUser, ok bool) {
+	var apikey ApiKey
+	err := pg.Get(&apikey, `
+UPDATE api_keys SET last_used_at = now()
+WHERE key_hash = $1
+RETURNING *
+    `, hashApiKey(key))
+	if err != nil {
+		return
+	}
+
+	token, err := openToken(apikey.Token)
+	if err != nil {
+		log.Warn().Err(err).Int("key", apikey.Id).Msg("failed to decrypt api key token")
+		return
+	}
+
+	return authUser{apikey.Member, apikey.Username, apikey.Email, token}, true
+}
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// createApiKey returns a new key that will act as the given user. only its
+// hash is stored, so it can't be shown again.
+func createApiKey(user authUser) (key string, err error) {
+	random := make([]byte, 24)
+	_, err = rand.Read(random)
+	if err != nil {
+		return
+	}
+	key = "pft_" + hex.EncodeToString(random)
+
+	sealed, err := sealToken(user.Token)
+	if err != nil {
+		return
+	}
+
+	_, err = pg.Exec(`
+INSERT INTO api_keys (member, username, email, token, key_hash, prefix)
+VALUES ($1, $2, $3, $4, $5, $6)
+    `, user.Id, user.Username, user.Email, sealed, hashApiKey(key), key[:8])
+	return
+}
+
+func handleCreateApiKey(w http.ResponseWriter, r *http.Request) {
+	// a leaked key mustn't be able to make more of them
+	user, ok := authenticateSession(r)
+	if !ok {
+		http.Redirect(w, r, "/auth", http.StatusFound)
+		return
+	}
+
+	key, err := createApiKey(user)
+	if err != nil {
+		http.Error(w, "failed to create api key: "+err.Error(), 500)
+		return
+	}
+
+	// show it once on the account page
+	sess, _ := store.Get(r, "auth-session")
+	sess.AddFlash(key, "apikey")
+	sess.Save(r, w)
+
+	http.Redirect(w, r, "/account", http.StatusFound)
+}
+
+func handleDeleteApiKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticateSession(r)
+	if !ok {
+		http.Redirect(w, r, "/auth", http.StatusFound)
+		return
+	}
+
+	_, err := pg.Exec(`
+DELETE FROM api_keys WHERE id = $1 AND member = $2
+    `, mux.Vars(r)["id"], user.Id)
+	if err != nil {
+		http.Error(w, "failed to delete api key: "+err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, "/account", http.StatusFound)
+}
@@ -1,21 +1,54 @@
 package main
 
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
 func initialBackup(board, token string) error {
 	log.Info().Str("board", board).Msg("performing initial backup")
-	trello := makeTrelloClient(token)
+
+	ctx, span := tracer.Start(context.Background(), "initialBackup",
+		trace.WithAttributes(attribute.String("board", board)))
+	defer span.End()
+
+	plaintoken, err := openToken(token)
+	if err != nil {
+		return err
+	}
+	trello := makeLoggedTrelloClient(ctx, log, plaintoken)
 
 	var b Board
-	err := trello("get", "/1/boards/"+board+
-		"?fields=id,shortLink,name"+
+	err = trello("get", "/1/boards/"+board+
+		"?fields=id,shortLink,name,closed,prefs,idOrganization"+
+		"&memberships=all"+
 		"&lists=none"+
 		"&labels=all&label_fields=id,color,name&labels_limit=1000"+
-		"&cards=all&card_fields=id,name,shortLink,desc,due,dueComplete,closed,idAttachmentCover,idList,idLabels,idChecklists,idMembers"+
+		"&cards=all&card_fields=id,name,shortLink,desc,due,dueComplete,closed,pos,idAttachmentCover,idList,idLabels,idChecklists,idMembers"+
 		"&card_members=false&card_attachments=true&card_attachment_fields=url,name"+
 		"&actions=commentCard&actions_limit=1000&actions_fields=date,data&action_member=false&action_memberCreator=true&action_memberCreator_fields=id,username",
 		nil, &b)
+	if err != nil {
+		return err
+	}
+
+	err = saveBackupData(ctx, board, board, map[string]interface{}{
+		"name":           b.Name,
+		"shortLink":      b.ShortLink,
+		"prefs":          b.Prefs,
+		"idOrganization": b.IdOrganization,
+		"memberships":    b.Memberships,
+	})
+	if err != nil {
+		// without this we can't revert changes to the board prefs or members
+		log.Warn().Err(err).Str("board", board).Msg("failed to backup board")
+		return err
+	}
 
 	for _, label := range b.Labels {
-		onAllowed(log, token, Webhook{
+		onAllowed(ctx, log, token, Webhook{
 			Action: Action{
 				Type: "createLabel",
 				Data: Data{
@@ -26,7 +59,7 @@ func initialBackup(board, token string) error {
 		})
 	}
 	for _, card := range b.Cards {
-		onAllowed(log, token, Webhook{
+		onAllowed(ctx, log, token, Webhook{
 			Action: Action{
 				Type: "createCard",
 				Data: Data{
@@ -37,7 +70,7 @@ func initialBackup(board, token string) error {
 		})
 
 		for _, att := range card.Attachments {
-			onAllowed(log, token, Webhook{
+			onAllowed(ctx, log, token, Webhook{
 				Action: Action{
 					Type: "addAttachmentToCard",
 					Data: Data{
@@ -55,7 +88,7 @@ func initialBackup(board, token string) error {
 			nil, &checklists)
 
 		for _, checklist := range checklists {
-			onAllowed(log, token, Webhook{
+			onAllowed(ctx, log, token, Webhook{
 				Action: Action{
 					Type: "addChecklistToCard",
 					Data: Data{
@@ -67,7 +100,7 @@ func initialBackup(board, token string) error {
 			})
 
 			for _, checkItem := range checklist.CheckItems {
-				onAllowed(log, token, Webhook{
+				onAllowed(ctx, log, token, Webhook{
 					Action: Action{
 						Type: "createCheckItem",
 						Data: Data{
@@ -82,10 +115,21 @@ func initialBackup(board, token string) error {
 		}
 	}
 	for _, action := range b.Actions {
-		onAllowed(log, token, Webhook{
+		onAllowed(ctx, log, token, Webhook{
 			Action: action,
 		})
 	}
 
 	return err
 }
+
+func backupBoardMemberships(ctx context.Context, trello trelloClient, boardId string) error {
+	memberships, err := boardMemberships(ctx, trello, boardId)
+	if err != nil {
+		return err
+	}
+
+	return saveBackupData(ctx, boardId, boardId, struct {
+		Memberships []Membership `json:"memberships"`
+	}{memberships})
+}
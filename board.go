@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type revertView struct {
+	Username    string
+	Description string
+	Date        string
+	Error       string
+}
+
+// ServeBoard shows the settings, health and recent reverts of a board to its
+// admins.
+func ServeBoard(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticate(r)
+	if !ok {
+		http.Redirect(w, r, "/auth", http.StatusFound)
+		return
+	}
+
+	trello := makeTrelloClient(user.Token)
+	boardId := mux.Vars(r)["id"]
+
+	if !isBoardAdmin(r.Context(), trello, user.Id, boardId) {
+		http.Error(w, "only board admins can see this page.", 403)
+		return
+	}
+
+	var board Board
+	err := trello("get", "/1/boards/"+boardId+"?fields=id,name,shortLink", nil, &board)
+	if err != nil {
+		http.Error(w, "failed to fetch trello board: "+err.Error(), 503)
+		return
+	}
+
+	var enabled Board
+	err = pg.Get(&enabled, `
+SELECT email, degraded, token_ok, webhook_ok, checked_at, settings FROM boards
+WHERE id = $1
+    `, board.Id)
+	if err == nil {
+		board.Enabled = true
+		board.Email = enabled.Email
+		board.Degraded = enabled.Degraded
+		board.TokenOk = enabled.TokenOk
+		board.WebhookOk = enabled.WebhookOk
+		board.CheckedAt = enabled.CheckedAt
+		board.Settings = enabled.Settings
+	}
+
+	// what happens to unallowed changes right now
+	mode := "disabled"
+	if board.Enabled {
+		mode = "reverting unallowed changes"
+		if board.Degraded {
+			mode = "stopped: no valid tokens"
+		} else if freeze, frozen := board.Settings.frozen(time.Now()); frozen {
+			mode = "frozen (" + freeze + "): reverting all changes by non-admins"
+		}
+	}
+
+	var reverts []Revert
+	err = pg.Select(&reverts, `
+SELECT * FROM reverts
+WHERE board = $1
+ORDER BY created_at DESC
+LIMIT 30
+    `, board.Id)
+	if err != nil {
+		http.Error(w, "failed to fetch reverted changes: "+err.Error(), 500)
+		return
+	}
+
+	views := make([]revertView, len(reverts))
+	for i, revert := range reverts {
+		var wh Webhook
+		revert.Webhook.Unmarshal(&wh)
+
+		views[i] = revertView{
+			Username:    wh.Action.MemberCreator.Username,
+			Description: describeAction(wh),
+			Date:        revert.CreatedAt.Format(PRETTYDATEFORMAT),
+			Error:       revert.Error,
+		}
+	}
+
+	sess, _ := store.Get(r, "auth-session")
+	var message string
+	if flashes := sess.Flashes("board"); len(flashes) > 0 {
+		message = flashes[0].(string)
+		sess.Save(r, w)
+	}
+
+	err = parsedtemplates.board.Execute(w, struct {
+		Username string
+		Board    Board
+		Mode     string
+		Reverts  []revertView
+		Message  string
+	}{user.Username, board, mode, views, message})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to render /boards/{id}")
+	}
+}
+
+// boards being backed up from handleBoardBackup
+var runningBackups = struct {
+	sync.Mutex
+	boards map[string]bool
+}{boards: make(map[string]bool)}
+
+// handleBoardBackup performs the initial backup of a board again.
+func handleBoardBackup(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticate(r)
+	if !ok {
+		http.Redirect(w, r, "/auth", http.StatusFound)
+		return
+	}
+
+	boardId := mux.Vars(r)["id"]
+	if !isBoardAdmin(r.Context(), makeTrelloClient(user.Token), user.Id, boardId) {
+		http.Error(w, "only board admins can do that.", 403)
+		return
+	}
+
+	var token string
+	err := pg.Get(&token, `SELECT token FROM boards WHERE id = $1`, boardId)
+	if err != nil {
+		http.Error(w, "board is not enabled.", 400)
+		return
+	}
+
+	sess, _ := store.Get(r, "auth-session")
+
+	runningBackups.Lock()
+	running := runningBackups.boards[boardId]
+	runningBackups.boards[boardId] = true
+	runningBackups.Unlock()
+
+	if running {
+		sess.AddFlash("A backup of this board is already running.", "board")
+	} else {
+		// it takes a while on big boards
+		goBackground(func() {
+			defer func() {
+				runningBackups.Lock()
+				delete(runningBackups.boards, boardId)
+				runningBackups.Unlock()
+			}()
+
+			err := initialBackup(boardId, token)
+			if err != nil {
+				log.Warn().Err(err).Str("board", boardId).Msg("failed to backup board")
+			}
+		})
+		sess.AddFlash("The backup is running, it may take a few minutes.", "board")
+	}
+	sess.Save(r, w)
+
+	http.Redirect(w, r, "/boards/"+boardId, http.StatusFound)
+}
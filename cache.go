@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const MEMBERSHIPSCACHETTL = time.Hour * 2
+const LOCALCACHESWEEP = time.Minute * 10
+
+// when there's no redis we cache things in memory
+var localCache = struct {
+	sync.Mutex
+	entries map[string]localCacheEntry
+	sweptAt time.Time
+}{entries: make(map[string]localCacheEntry), sweptAt: time.Now()}
+
+type localCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func cacheGet(key string, v interface{}) bool {
+	var data []byte
+
+	if s.RedisURL != "" {
+		b, err := rds.Get(key).Bytes()
+		if err != nil {
+			return false
+		}
+		data = b
+	} else {
+		localCache.Lock()
+		entry, ok := localCache.entries[key]
+		if ok && time.Now().After(entry.expires) {
+			delete(localCache.entries, key)
+			ok = false
+		}
+		localCache.Unlock()
+		if !ok {
+			return false
+		}
+		data = entry.value
+	}
+
+	return json.Unmarshal(data, v) == nil
+}
+
+func cacheSet(key string, v interface{}, ttl time.Duration) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	if s.RedisURL != "" {
+		err = rds.Set(key, data, ttl).Err()
+		if err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("failed to cache")
+		}
+		return
+	}
+
+	now := time.Now()
+	localCache.Lock()
+	localCache.entries[key] = localCacheEntry{data, now.Add(ttl)}
+
+	// most keys are never read again after they expire, so they must be
+	// dropped from time to time or they would pile up forever
+	if now.Sub(localCache.sweptAt) > LOCALCACHESWEEP {
+		for k, entry := range localCache.entries {
+			if now.After(entry.expires) {
+				delete(localCache.entries, k)
+			}
+		}
+		localCache.sweptAt = now
+	}
+	localCache.Unlock()
+}
+
+func cacheDel(keys ...string) {
+	if s.RedisURL != "" {
+		err := rds.Del(keys...).Err()
+		if err != nil {
+			log.Warn().Err(err).Strs("keys", keys).Msg("failed to invalidate cache")
+		}
+		return
+	}
+
+	localCache.Lock()
+	for _, key := range keys {
+		delete(localCache.entries, key)
+	}
+	localCache.Unlock()
+}
+
+func boardMemberships(ctx context.Context, trello trelloClient, boardId string) (memberships []Membership, err error) {
+	if cacheGet("memberships:"+boardId, &memberships) {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache.memberships.hit", true))
+		return
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache.memberships.hit", false))
+
+	err = trello("get", "/1/boards/"+boardId+
+		"/memberships?filter=all&member=false&orgMemberType=true",
+		nil, &memberships)
+	if err != nil {
+		return
+	}
+
+	cacheSet("memberships:"+boardId, memberships, MEMBERSHIPSCACHETTL)
+	return
+}
+
+func cardMembers(ctx context.Context, trello trelloClient, cardId string) (idMembers []string, err error) {
+	if cacheGet("cardmembers:"+cardId, &idMembers) {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache.cardmembers.hit", true))
+		return
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache.cardmembers.hit", false))
+
+	var members []struct {
+		Id string `json:"id"`
+	}
+	err = trello("get", "/1/cards/"+cardId+"/members?fields=id", nil, &members)
+	if err != nil {
+		return
+	}
+
+	idMembers = make([]string, len(members))
+	for i, m := range members {
+		idMembers[i] = m.Id
+	}
+
+	cacheSet("cardmembers:"+cardId, idMembers, MEMBERSHIPSCACHETTL)
+	return
+}
+
+func invalidateBoardMemberships(boardId string) {
+	cacheDel("memberships:" + boardId)
+}
+
+func invalidateCardMembers(cardId string) {
+	cacheDel("cardmembers:" + cardId)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const USAGE = `usage: permissionsfortrello <command>
+
+commands:
+  serve                           run the web server (the default)
+  boards list                     list enabled boards and their health
+  boards enable <board>           enable a board with the token in TRELLO_TOKEN
+  boards disable <board>          disable a board with the token in TRELLO_TOKEN
+  backup run <board>              perform the initial backup of a board again
+  restore card <card>             recreate a deleted card from its backup
+  webhooks verify [<board>...]    check tokens and webhooks, recreating them if needed
+  rotate-tokens                   encrypt all tokens with the current key
+`
+
+// runCommand runs the subcommands that can be given to the binary instead
+// of serving the website.
+func runCommand(args []string) (err error) {
+	arg := func(i int) string {
+		if len(args) > i {
+			return args[i]
+		}
+		return ""
+	}
+
+	switch strings.TrimSpace(arg(0) + " " + arg(1)) {
+	case "boards list":
+		return listBoards()
+	case "boards enable", "boards disable":
+		if arg(2) == "" {
+			break
+		}
+		var user authUser
+		user, err = trelloProfile(os.Getenv("TRELLO_TOKEN"))
+		if err != nil {
+			return errors.New("TRELLO_TOKEN must be a valid token of a board admin: " + err.Error())
+		}
+		return setupBoard(arg(2), user.Id, user.Email, user.Token, arg(1) == "enable")
+	case "backup run":
+		if arg(2) == "" {
+			break
+		}
+		var token string
+		err = pg.Get(&token, `SELECT token FROM boards WHERE id = $1`, arg(2))
+		if err != nil {
+			return errors.New("board is not enabled.")
+		}
+		return initialBackup(arg(2), token)
+	case "restore card":
+		if arg(2) == "" {
+			break
+		}
+		var boardId string
+		err = pg.Get(&boardId, `SELECT board FROM backups WHERE id = $1`, arg(2))
+		if err != nil {
+			return errors.New("card not found on backups.")
+		}
+		return restoreCard(boardId, arg(2), "")
+	case "webhooks verify":
+		boardIds := args[2:]
+		if len(boardIds) == 0 {
+			err = pg.Select(&boardIds, `SELECT id FROM boards`)
+			if err != nil {
+				return
+			}
+		}
+		return verifyBoards(boardIds)
+	case "rotate-tokens":
+		rotated, err := rotateTokens()
+		if err != nil {
+			log.Warn().Msg("rotation failed, no tokens were changed")
+			return err
+		}
+		log.Info().Int("rotated", rotated).Str("key", currentTokenKeyId).
+			Msg("tokens rotated.")
+		return nil
+	}
+
+	fmt.Fprint(os.Stderr, USAGE)
+	return errors.New("unknown command: " + strings.Join(args, " "))
+}
+
+func listBoards() (err error) {
+	var boards []Board
+	err = pg.Select(&boards, `
+SELECT id, email, degraded, token_ok, webhook_ok, checked_at FROM boards
+ORDER BY id
+    `)
+	if err != nil {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BOARD\tEMAIL\tTOKEN\tWEBHOOK\tCHECKED")
+	for _, board := range boards {
+		token := "ok"
+		if board.Degraded {
+			token = "degraded"
+		} else if !board.TokenOk {
+			token = "revoked"
+		}
+		webhook := "ok"
+		if !board.WebhookOk {
+			webhook = "missing"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", board.Id, board.Email, token, webhook,
+			board.CheckedAt.Format(PRETTYDATEFORMAT))
+	}
+	return w.Flush()
+}
+
+// verifyBoards runs the same checks the periodic health check does.
+func verifyBoards(boardIds []string) (err error) {
+	failed := 0
+	for _, boardId := range boardIds {
+		err = checkBoardHealth(boardId)
+		if err != nil {
+			log.Warn().Err(err).Str("board", boardId).Msg("failed to check board health")
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d boards couldn't be checked", failed, len(boardIds))
+	}
+	return listBoards()
+}
@@ -4,3 +4,9 @@ const (
 	TRELLODATEFORMAT = "2006-01-02T15:04:05.000Z"
 	PRETTYDATEFORMAT = "January 02 2006, 15:04:05 UTC"
 )
+
+// who is allowed to make a kind of change
+const (
+	ALLOWADMINS  = "admins"
+	ALLOWMEMBERS = "members" // card members and admins
+)
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// backups of cards deleted by allowed users are kept for this long
+const DELETEDRETENTION = time.Hour * 24 * 30
+
+type deletedCardView struct {
+	Id        string
+	Name      string
+	Board     Board
+	DeletedBy string
+	Date      string
+}
+
+func ServeDeleted(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticate(r)
+	if !ok {
+		http.Redirect(w, r, "/auth", http.StatusFound)
+		return
+	}
+
+	boards, err := adminBoards(makeTrelloClient(user.Token), user.Username)
+	if err != nil {
+		http.Error(w, "failed to fetch trello boards: "+err.Error(), 503)
+		return
+	}
+
+	boardids := make([]string, len(boards))
+	for i, board := range boards {
+		boardids[i] = board.Id
+	}
+
+	var deleted []struct {
+		Id        string         `db:"id"`
+		Board     string         `db:"board"`
+		Data      types.JSONText `db:"data"`
+		DeletedAt time.Time      `db:"deleted_at"`
+		DeletedBy string         `db:"deleted_by"`
+	}
+	err = pg.Select(&deleted, `
+SELECT id, board, data, deleted_at, deleted_by FROM backups
+WHERE deleted_at > now() - make_interval(secs => $2)
+  AND board = ANY (string_to_array($1, ','))
+ORDER BY deleted_at DESC
+    `, strings.Join(boardids, ","), DELETEDRETENTION.Seconds())
+	if err != nil {
+		http.Error(w, "failed to fetch deleted cards: "+err.Error(), 500)
+		return
+	}
+
+	views := make([]deletedCardView, 0, len(deleted))
+	for _, d := range deleted {
+		var card Card
+		d.Data.Unmarshal(&card)
+
+		view := deletedCardView{
+			Id:        d.Id,
+			Name:      card.Name,
+			DeletedBy: d.DeletedBy,
+			Date:      d.DeletedAt.Format(PRETTYDATEFORMAT),
+		}
+		for _, board := range boards {
+			if board.Id == d.Board {
+				view.Board = board
+			}
+		}
+		views = append(views, view)
+	}
+
+	err = parsedtemplates.deleted.Execute(w, struct {
+		Username string
+		Cards    []deletedCardView
+	}{user.Username, views})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to render /deleted")
+	}
+}
+
+func handleRestoreDeleted(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticate(r)
+	if !ok {
+		http.Redirect(w, r, "/auth", http.StatusFound)
+		return
+	}
+
+	boardId := mux.Vars(r)["board"]
+	if !isBoardAdmin(r.Context(), makeTrelloClient(user.Token), user.Id, boardId) {
+		http.Error(w, "only board admins can restore cards.", 403)
+		return
+	}
+
+	err := restoreCard(boardId, mux.Vars(r)["card"], user.Username)
+	if err != nil {
+		http.Error(w, "failed to restore card: "+err.Error(), 400)
+		return
+	}
+
+	http.Redirect(w, r, "/deleted", http.StatusFound)
+}
+
+// purgeDeletedCards removes the backups of cards deleted longer ago than
+// DELETEDRETENTION, along with their checklists, checkItems and attachments
+// (and the copies of uploaded files we keep on S3).
+func purgeDeletedCards() (err error) {
+	var attachments []struct {
+		Id   string         `db:"id"`
+		Data types.JSONText `db:"data"`
+	}
+	err = pg.Select(&attachments, `
+WITH
+expired AS (
+  DELETE FROM backups
+  WHERE deleted_at < now() - make_interval(secs => $1)
+  RETURNING data
+),
+checklists AS (
+  DELETE FROM backups
+  WHERE to_jsonb(id) IN (
+    SELECT jsonb_array_elements(coalesce(data->'idChecklists', '[]'))
+    FROM expired
+  )
+  RETURNING data
+),
+checkitems AS (
+  DELETE FROM backups
+  WHERE to_jsonb(id) IN (
+    SELECT jsonb_array_elements(coalesce(data->'idCheckItems', '[]'))
+    FROM checklists
+  )
+)
+DELETE FROM backups
+WHERE to_jsonb(id) IN (
+  SELECT jsonb_array_elements(coalesce(data->'idAttachments', '[]'))
+  FROM expired
+)
+RETURNING id, data
+    `, DELETEDRETENTION.Seconds())
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	for _, row := range attachments {
+		var att Attachment
+		row.Data.Unmarshal(&att)
+		if att.Url == "" || !attachmentIsUploaded(att) {
+			continue
+		}
+
+		err = deleteFromS3(ctx, row.Id)
+		if err != nil {
+			log.Warn().Err(err).Str("attachment", row.Id).
+				Msg("failed to delete purged attachment from s3")
+		}
+	}
+	return nil
+}
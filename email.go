@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/smtp"
+	"strings"
+)
+
+func sendEmail(to []string, subject, body string) error {
+	if s.SMTPHost == "" {
+		log.Debug().Strs("to", to).Str("subject", subject).
+			Msg("smtp not configured, not sending email")
+		return nil
+	}
+
+	var auth smtp.Auth
+	if s.SMTPUser != "" {
+		auth = smtp.PlainAuth("", s.SMTPUser, s.SMTPPassword, s.SMTPHost)
+	}
+
+	msg := "From: " + s.SMTPFrom + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1)
+
+	return smtp.SendMail(s.SMTPHost+":"+s.SMTPPort, auth, s.SMTPFrom, to, []byte(msg))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// reverts happening within this time are explained on a single comment
+	EXPLAINDELAY = time.Second * 15
+	// and after a comment is posted no other will be posted for this time
+	EXPLAINCOOLDOWN = time.Minute * 10
+)
+
+var pendingExplanations = struct {
+	sync.Mutex
+	byKey map[string]*explanation
+}{byKey: make(map[string]*explanation)}
+
+type explanation struct {
+	token    string
+	cardId   string
+	username string
+	who      string
+	reverted []string
+	timer    *time.Timer
+
+	// of the first reset, plus the ids of the actions grouped with it
+	logger  zerolog.Logger
+	grouped []string
+}
+
+// explainRevert comments on the card telling the user why the change was
+// reverted. bursts of reverts on the same card by the same user are grouped
+// in a single comment.
+func explainRevert(logger zerolog.Logger, token string, wh Webhook, who string) {
+	switch wh.Action.Type {
+	case "createCard", "copyCard", "convertToCardFromCheckItem",
+		"deleteCard", "moveCardToBoard":
+		// the card isn't there anymore (or has another id)
+		return
+	}
+
+	key := "explained:" + wh.Action.Data.Card.Id + ":" + wh.Action.MemberCreator.Id
+	var recently bool
+	if cacheGet(key, &recently) {
+		return
+	}
+
+	pendingExplanations.Lock()
+	defer pendingExplanations.Unlock()
+
+	if e, ok := pendingExplanations.byKey[key]; ok {
+		e.reverted = append(e.reverted, describeAction(wh))
+		e.grouped = append(e.grouped, wh.Action.Id)
+		return
+	}
+
+	e := &explanation{
+		token:    token,
+		cardId:   wh.Action.Data.Card.Id,
+		username: wh.Action.MemberCreator.Username,
+		who:      who,
+		reverted: []string{describeAction(wh)},
+		logger:   logger,
+	}
+	pendingExplanations.byKey[key] = e
+
+	delay := EXPLAINDELAY
+	if isDraining() {
+		delay = 0
+	}
+
+	startWork()
+	e.timer = time.AfterFunc(delay, func() {
+		pendingExplanations.Lock()
+		delete(pendingExplanations.byKey, key)
+		pendingExplanations.Unlock()
+
+		sendExplanation(key, e)
+	})
+}
+
+func sendExplanation(key string, e *explanation) {
+	defer finishWork()
+
+	cacheSet(key, true, EXPLAINCOOLDOWN)
+
+	err := postExplanation(e)
+	if err != nil {
+		e.logger.Warn().Err(err).Strs("grouped", e.grouped).
+			Msg("failed to explain revert")
+	}
+}
+
+// flushExplanations posts right away the explanations that are waiting
+// for more reverts to be grouped with.
+func flushExplanations() {
+	pendingExplanations.Lock()
+	flushed := make(map[string]*explanation)
+	for key, e := range pendingExplanations.byKey {
+		if e.timer.Stop() {
+			flushed[key] = e
+			delete(pendingExplanations.byKey, key)
+		}
+	}
+	pendingExplanations.Unlock()
+
+	for key, e := range flushed {
+		key, e := key, e
+		goBackground(func() { sendExplanation(key, e) })
+	}
+}
+
+func postExplanation(e *explanation) error {
+	plaintoken, err := openToken(e.token)
+	if err != nil {
+		return err
+	}
+	trello := makeLoggedTrelloClient(context.Background(), e.logger, plaintoken)
+
+	text := "@" + e.username + " "
+	if len(e.reverted) == 1 {
+		text += "your change was reverted: " + e.reverted[0] + ". "
+	} else {
+		text += "your changes were reverted:\n\n- " +
+			strings.Join(e.reverted, "\n- ") + "\n\n"
+	}
+	text += e.who
+
+	return trello("post", "/1/cards/"+e.cardId+"/actions/comments", Comment{
+		Text: text,
+	}, nil)
+}
+
+// whoIsAllowed tells in words who could have made the change.
+func whoIsAllowed(settings BoardSettings, wh Webhook, freeze string) string {
+	var who string
+	if freeze != "" {
+		who = "The board is frozen (" + freeze + "), so only board admins can change it."
+	} else {
+		who = "Only board admins and members of this card can do that."
+		for _, kind := range cardChangeKinds(wh) {
+			if settings.allowed(kind) == ALLOWADMINS {
+				who = "Only board admins can do that."
+			}
+		}
+	}
+
+	if settings.Approvals && replayableActions[wh.Action.Type] {
+		who += " An admin may still approve it."
+	}
+	return who
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+type contextKey string
+
+const USERKEY contextKey = "user"
+
+func buildSchema() (err error) {
+	labelType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Label",
+		Fields: graphql.Fields{
+			"id":    &graphql.Field{Type: graphql.String},
+			"name":  &graphql.Field{Type: graphql.String},
+			"color": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	checkItemType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "CheckItem",
+		Fields: graphql.Fields{
+			"id":    &graphql.Field{Type: graphql.String},
+			"name":  &graphql.Field{Type: graphql.String},
+			"state": &graphql.Field{Type: graphql.String},
+			"pos":   &graphql.Field{Type: graphql.Float},
+		},
+	})
+
+	checklistType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Checklist",
+		Fields: graphql.Fields{
+			"id":   &graphql.Field{Type: graphql.String},
+			"name": &graphql.Field{Type: graphql.String},
+			"checkItems": &graphql.Field{
+				Type: graphql.NewList(checkItemType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					checklist := p.Source.(Checklist)
+					items := make([]CheckItem, 0, len(checklist.IdCheckItems))
+					for _, id := range checklist.IdCheckItems {
+						var item CheckItem
+						if fetchBackupData(p.Context, id, &item) == nil {
+							item.Id = id
+							items = append(items, item)
+						}
+					}
+					return items, nil
+				},
+			},
+		},
+	})
+
+	commentType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Comment",
+		Fields: graphql.Fields{
+			"id":       &graphql.Field{Type: graphql.String},
+			"text":     &graphql.Field{Type: graphql.String},
+			"date":     &graphql.Field{Type: graphql.String},
+			"userId":   &graphql.Field{Type: graphql.String},
+			"username": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	cardType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Card",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.String},
+			"shortLink":   &graphql.Field{Type: graphql.String},
+			"idList":      &graphql.Field{Type: graphql.String},
+			"name":        &graphql.Field{Type: graphql.String},
+			"desc":        &graphql.Field{Type: graphql.String},
+			"due":         &graphql.Field{Type: graphql.String},
+			"dueComplete": &graphql.Field{Type: graphql.Boolean},
+			"closed":      &graphql.Field{Type: graphql.Boolean},
+			"pos":         &graphql.Field{Type: graphql.Float},
+			"idMembers":   &graphql.Field{Type: graphql.NewList(graphql.String)},
+			"idLabels":    &graphql.Field{Type: graphql.NewList(graphql.String)},
+			"checklists": &graphql.Field{
+				Type: graphql.NewList(checklistType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					card := p.Source.(Card)
+					checklists := make([]Checklist, 0, len(card.IdChecklists))
+					for _, id := range card.IdChecklists {
+						var checklist Checklist
+						if fetchBackupData(p.Context, id, &checklist) == nil {
+							checklist.Id = id
+							checklists = append(checklists, checklist)
+						}
+					}
+					return checklists, nil
+				},
+			},
+			"comments": &graphql.Field{
+				Type: graphql.NewList(commentType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return commentLog(p.Source.(Card).Comments), nil
+				},
+			},
+		},
+	})
+
+	boardType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Board",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.String},
+			"name":      &graphql.Field{Type: graphql.String},
+			"shortLink": &graphql.Field{Type: graphql.String},
+			"enabled":   &graphql.Field{Type: graphql.Boolean},
+			"email":     &graphql.Field{Type: graphql.String},
+			"degraded":  &graphql.Field{Type: graphql.Boolean},
+			"tokenOk":   &graphql.Field{Type: graphql.Boolean},
+			"webhookOk": &graphql.Field{Type: graphql.Boolean},
+			"checkedAt": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					board := p.Source.(Board)
+					if !board.Enabled {
+						return nil, nil
+					}
+					return board.CheckedAt.Format(TRELLODATEFORMAT), nil
+				},
+			},
+			"settings": &graphql.Field{
+				Type:        graphql.String,
+				Description: "the board settings as JSON",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					j, err := json.Marshal(p.Source.(Board).Settings)
+					return string(j), err
+				},
+			},
+			"cards": &graphql.Field{
+				Type: graphql.NewList(cardType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return backedUpCards(p.Source.(Board).Id)
+				},
+			},
+			"labels": &graphql.Field{
+				Type: graphql.NewList(labelType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return backedUpLabels(p.Source.(Board).Id)
+				},
+			},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"boards": &graphql.Field{
+				Type: graphql.NewList(boardType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user := p.Context.Value(USERKEY).(authUser)
+					return userBoards(user)
+				},
+			},
+			"board": &graphql.Field{
+				Type: boardType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user := p.Context.Value(USERKEY).(authUser)
+					boards, err := userBoards(user)
+					if err != nil {
+						return nil, err
+					}
+					id := p.Args["id"].(string)
+					for _, board := range boards {
+						if board.Id == id || board.ShortLink == id {
+							return board, nil
+						}
+					}
+					return nil, errors.New("board not found or you're not an admin on it.")
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"enableBoard": &graphql.Field{
+				Type: graphql.Boolean,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user := p.Context.Value(USERKEY).(authUser)
+					err := setupBoard(p.Args["id"].(string), user.Id, user.Email, user.Token, true)
+					return err == nil, err
+				},
+			},
+			"disableBoard": &graphql.Field{
+				Type: graphql.Boolean,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user := p.Context.Value(USERKEY).(authUser)
+					err := setupBoard(p.Args["id"].(string), user.Id, user.Email, user.Token, false)
+					return err == nil, err
+				},
+			},
+			"restoreCard": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "recreates a deleted card from its backup",
+				Args: graphql.FieldConfigArgument{
+					"board": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user := p.Context.Value(USERKEY).(authUser)
+					boardId := p.Args["board"].(string)
+					if !isBoardAdmin(p.Context, makeTrelloClient(user.Token), user.Id, boardId) {
+						return false, errors.New("only board admins can restore cards.")
+					}
+					err := restoreCard(boardId, p.Args["id"].(string), user.Username)
+					return err == nil, err
+				},
+			},
+		},
+	})
+
+	schema, err = graphql.NewSchema(graphql.SchemaConfig{
+		Query:    query,
+		Mutation: mutation,
+	})
+	return
+}
+
+// userBoards lists all boards the user is an admin of, with the state of
+// the ones that are enabled.
+func userBoards(user authUser) (boards []Board, err error) {
+	boards, err = adminBoards(makeTrelloClient(user.Token), user.Username)
+	if err != nil {
+		return
+	}
+
+	boardids := make([]string, len(boards))
+	for i, board := range boards {
+		boardids[i] = board.Id
+	}
+
+	var enabledboards []Board
+	err = pg.Select(&enabledboards, `
+SELECT id, email, degraded, token_ok, webhook_ok, checked_at, settings FROM boards
+WHERE id = ANY (string_to_array($1, ','))
+    `, strings.Join(boardids, ","))
+	if err != nil {
+		return
+	}
+
+	for i, iboard := range boards {
+		for _, jboard := range enabledboards {
+			if iboard.Id == jboard.Id {
+				boards[i].Email = jboard.Email
+				boards[i].Degraded = jboard.Degraded
+				boards[i].TokenOk = jboard.TokenOk
+				boards[i].WebhookOk = jboard.WebhookOk
+				boards[i].CheckedAt = jboard.CheckedAt
+				boards[i].Settings = jboard.Settings
+				boards[i].Enabled = true
+			}
+		}
+	}
+	return
+}
+
+func backedUpCards(boardId string) (cards []Card, err error) {
+	var rows []struct {
+		Id   string `db:"id"`
+		Data []byte `db:"data"`
+	}
+	err = pg.Select(&rows, `
+SELECT id, data FROM backups
+WHERE board = $1 AND id != board AND data ? 'shortLink' AND deleted_at IS NULL
+    `, boardId)
+	if err != nil {
+		return
+	}
+
+	cards = make([]Card, 0, len(rows))
+	for _, row := range rows {
+		var card Card
+		if json.Unmarshal(row.Data, &card) == nil {
+			card.Id = row.Id
+			cards = append(cards, card)
+		}
+	}
+	return
+}
+
+func backedUpLabels(boardId string) (labels []Label, err error) {
+	var rows []struct {
+		Id   string `db:"id"`
+		Data []byte `db:"data"`
+	}
+	err = pg.Select(&rows, `
+SELECT id, data FROM backups
+WHERE board = $1 AND data->>'idBoard' = board AND NOT data ? 'shortLink'
+    `, boardId)
+	if err != nil {
+		return
+	}
+
+	labels = make([]Label, 0, len(rows))
+	for _, row := range rows {
+		var label Label
+		if json.Unmarshal(row.Data, &label) == nil {
+			label.Id = row.Id
+			labels = append(labels, label)
+		}
+	}
+	return
+}
+
+// commentLog takes the immutable log of comments saved on a card backup and
+// returns only the last version of each comment, skipping deleted ones.
+func commentLog(entries []Comment) []Comment {
+	last := make(map[string]Comment)
+	for _, comment := range entries {
+		if prev, ok := last[comment.Id]; !ok || comment.Date >= prev.Date {
+			last[comment.Id] = comment
+		}
+	}
+
+	comments := make([]Comment, 0, len(last))
+	for _, comment := range last {
+		if comment.Text != "" {
+			comments = append(comments, comment)
+		}
+	}
+	sort.Slice(comments, func(i, j int) bool { return comments[i].Date < comments[j].Date })
+	return comments
+}
+
+func handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticate(r)
+	if !ok {
+		http.Error(w, "log in or send an api key.", 401)
+		return
+	}
+
+	// the session cookie is sent along with requests made from other sites,
+	// so these must be requests a plain form or link can't make
+	if requestApiKey(r) == "" && (r.Method != "POST" || !isJSONRequest(r)) {
+		http.Error(w, "send a POST with Content-Type: application/json.", 400)
+		return
+	}
+
+	var params struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	if r.Method == "GET" {
+		params.Query = r.URL.Query().Get("query")
+		params.OperationName = r.URL.Query().Get("operationName")
+		json.Unmarshal([]byte(r.URL.Query().Get("variables")), &params.Variables)
+
+		if hasMutation(params.Query) {
+			http.Error(w, "mutations must be sent with POST.", 405)
+			return
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&params)
+		if err != nil {
+			http.Error(w, "invalid request: "+err.Error(), 400)
+			return
+		}
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         schema,
+		RequestString:  params.Query,
+		VariableValues: params.Variables,
+		OperationName:  params.OperationName,
+		Context:        context.WithValue(r.Context(), USERKEY, user),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// hasMutation tells if any operation in the query is a mutation. queries we
+// can't parse are reported as mutations, to be safe.
+func hasMutation(query string) bool {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return true
+	}
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok && op.Operation == ast.OperationTypeMutation {
+			return true
+		}
+	}
+	return false
+}
@@ -3,11 +3,9 @@ package main
 import (
 	"database/sql"
 	"net/http"
-	"net/url"
 	"strings"
 
 	"github.com/mrjones/oauth"
-	"gopkg.in/jmcvetta/napping.v3"
 )
 
 func ServeIndex(w http.ResponseWriter, r *http.Request) {
@@ -27,7 +25,7 @@ func TrelloAuth(w http.ResponseWriter, r *http.Request) {
 
 	token, url, err := c.GetRequestTokenAndUrl("http://" + r.Host + "/auth/callback")
 	if err != nil {
-		log.Print(err)
+		log.Warn().Err(err).Msg("failed to get oauth request token")
 		http.Error(w, "Couldn't redirect you to Trello.", 503)
 		return
 	}
@@ -60,17 +58,8 @@ func TrelloAuthCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var profile struct {
-		Id       string `json:"id"`
-		Username string `json:"username"`
-		Email    string `json:"email"`
-	}
-	response, err := napping.Get("https://trello.com/1/members/me", &url.Values{
-		"key":    []string{s.TrelloApiKey},
-		"token":  []string{accessToken.Token},
-		"fields": []string{"username,id,email"},
-	}, &profile, nil)
-	if err != nil || response.Status() > 299 {
+	profile, err := trelloProfile(accessToken.Token)
+	if err != nil {
 		http.Error(w, "Failed to fetch your profile info from Trello. This is odd.", 503)
 		return
 	}
@@ -90,7 +79,8 @@ func ServeAccount(w http.ResponseWriter, r *http.Request) {
 	username, ok1 := sess.Values["username"]
 	token, ok2 := sess.Values["token"]
 	email, ok3 := sess.Values["email"]
-	if !ok1 || !ok2 || !ok3 {
+	id, ok4 := sess.Values["id"]
+	if !ok1 || !ok2 || !ok3 || !ok4 {
 		http.Redirect(w, r, "/auth", http.StatusFound)
 		return
 	}
@@ -98,24 +88,12 @@ func ServeAccount(w http.ResponseWriter, r *http.Request) {
 	trello := makeTrelloClient(token.(string))
 
 	// get all boards for which this user is an admin
-	var allboards []Board
-	err := trello("get",
-		"/1/members/"+username.(string)+
-			"/boards?filter=open&fields=id,shortLink,name,memberships&memberships=me",
-		nil, &allboards)
+	boards, err := adminBoards(trello, username.(string))
 	if err != nil {
 		http.Error(w, "failed to fetch trello boards: "+err.Error(), 503)
 		return
 	}
 
-	var boards []Board
-	for _, board := range allboards {
-		m := board.Memberships[0]
-		if m.MemberType == "admin" || m.OrgMemberType == "admin" {
-			boards = append(boards, board)
-		}
-	}
-
 	// make an array of board ids so we can query
 	boardids := make([]string, len(boards))
 	for i, board := range boards {
@@ -134,21 +112,62 @@ WHERE id = ANY (string_to_array($1, ','))
 		return
 	}
 
+	// boards to which this user's token is attached
+	var attachedboards []string
+	err = pg.Select(&attachedboards, `
+SELECT board FROM tokens
+WHERE member = $1 AND valid AND board = ANY (string_to_array($2, ','))
+    `, id.(string), strings.Join(boardids, ","))
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "failed to fetch attached tokens: "+err.Error(), 500)
+		return
+	}
+
 	// merge enabled properties on full boards list
 	for i, iboard := range boards {
 		for _, jboard := range enabledboards {
 			if iboard.Id == jboard.Id {
 				boards[i].Email = jboard.Email
+				boards[i].Degraded = jboard.Degraded
+				boards[i].TokenOk = jboard.TokenOk
+				boards[i].WebhookOk = jboard.WebhookOk
+				boards[i].CheckedAt = jboard.CheckedAt
 				boards[i].Enabled = true
 			}
 		}
+		for _, attached := range attachedboards {
+			if iboard.Id == attached {
+				boards[i].Attached = true
+			}
+		}
+	}
+
+	// personal api keys
+	var apikeys []ApiKey
+	err = pg.Select(&apikeys, `
+SELECT * FROM api_keys
+WHERE member = $1
+ORDER BY created_at
+    `, id.(string))
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "failed to fetch api keys: "+err.Error(), 500)
+		return
+	}
+
+	// a key that was just created is shown only once
+	var newkey string
+	if flashes := sess.Flashes("apikey"); len(flashes) > 0 {
+		newkey = flashes[0].(string)
+		sess.Save(r, w)
 	}
 
 	err = parsedtemplates.account.Execute(w, struct {
 		Username string
 		Email    string
 		Boards   []Board
-	}{username.(string), email.(string), boards})
+		ApiKeys  []ApiKey
+		NewKey   string
+	}{username.(string), email.(string), boards, apikeys, newkey})
 	if err != nil {
 		log.Warn().Err(err).Msg("failed to render /account")
 	}
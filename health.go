@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+func startHealthChecks() {
+	for {
+		var boardIds []string
+		err := pg.Select(&boardIds, `SELECT id FROM boards`)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to fetch boards for health check")
+		}
+
+		for _, boardId := range boardIds {
+			err = checkBoardHealth(boardId)
+			if err != nil {
+				log.Warn().Err(err).Str("board", boardId).
+					Msg("failed to check board health")
+			}
+		}
+
+		err = purgeDeletedCards()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to purge old deleted cards")
+		}
+
+		err = purgeReverts()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to purge old reverts")
+		}
+
+		err = purgeApprovals()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to purge old approvals")
+		}
+
+		time.Sleep(s.HealthCheckInterval)
+	}
+}
+
+// checkBoardHealth validates the board token (failing over to the other
+// tokens attached to it when it was revoked) and makes sure its webhook
+// still exists and is active, recreating it if needed.
+func checkBoardHealth(boardId string) (err error) {
+	logger := log.With().Str("board", boardId).Logger()
+
+	var board Board
+	err = pg.Get(&board, `
+SELECT token, webhook_id FROM boards
+WHERE id = $1
+    `, boardId)
+	if err != nil {
+		return
+	}
+
+	tokenOk := false
+	webhookOk := false
+	var trello trelloClient
+
+	for {
+		var plaintoken string
+		plaintoken, err = openToken(board.Token)
+		if err != nil {
+			return
+		}
+		trello = makeTrelloClient(plaintoken)
+
+		err = trello("get", "/1/tokens/"+plaintoken+"?fields=id", nil, nil)
+		if err == nil {
+			tokenOk = true
+			break
+		}
+		if status := trelloStatus(err); status != 401 && status != 404 {
+			// trello is probably having a bad time, try later
+			return
+		}
+
+		logger.Info().Msg("token revoked, failing over")
+		board.Token, err = failoverToken(boardId, board.Token)
+		if err == sql.ErrNoRows {
+			err = degradeBoard(boardId)
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed to flag board as degraded")
+			}
+			break
+		} else if err != nil {
+			return
+		}
+	}
+
+	if tokenOk {
+		// webhooks belong to the token that created them, so if we failed
+		// over to another token the previous webhook won't be found here
+		var webhook struct {
+			Id     string `json:"id"`
+			Active bool   `json:"active"`
+		}
+		err = trello("get", "/1/webhooks/"+board.WebhookId, nil, &webhook)
+		if err == nil && webhook.Active {
+			webhookOk = true
+		} else if err == nil {
+			logger.Info().Str("webhook", board.WebhookId).Msg("reactivating webhook")
+			err = trello("put", "/1/webhooks/"+board.WebhookId, struct {
+				Active bool `json:"active"`
+			}{true}, nil)
+			webhookOk = err == nil
+		} else if status := trelloStatus(err); status >= 400 && status < 500 {
+			logger.Info().Str("webhook", board.WebhookId).Msg("recreating webhook")
+			// it may still exist under a token that is valid, and we don't
+			// want trello to send us everything twice
+			if !deleteWebhook(boardId, board.WebhookId) {
+				logger.Warn().Str("webhook", board.WebhookId).
+					Msg("couldn't delete previous webhook with any token")
+			}
+			board.WebhookId, err = createWebhook(trello, boardId)
+			if err == nil {
+				webhookOk = true
+				_, err = pg.Exec(`
+UPDATE boards SET webhook_id = $2
+WHERE id = $1
+                `, boardId, board.WebhookId)
+			}
+		}
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to check webhook")
+		}
+	}
+
+	_, err = pg.Exec(`
+UPDATE boards
+SET token_ok = $2, webhook_ok = $3, checked_at = now()
+WHERE id = $1
+    `, boardId, tokenOk, webhookOk)
+	return
+}
+
+// deleteWebhook tries to delete a board webhook with each token attached to
+// the board, since only the token that created it can do that.
+// returns true when one of them did it.
+func deleteWebhook(boardId, webhookId string) bool {
+	var tokens []string
+	err := pg.Select(&tokens, `
+SELECT token FROM tokens WHERE board = $1
+UNION
+SELECT token FROM boards WHERE id = $1
+    `, boardId)
+	if err != nil {
+		log.Warn().Err(err).Str("board", boardId).Msg("failed to fetch board tokens")
+		return false
+	}
+
+	for _, sealed := range tokens {
+		plaintoken, err := openToken(sealed)
+		if err != nil {
+			continue
+		}
+
+		err = makeTrelloClient(plaintoken)("delete", "/1/webhooks/"+webhookId, nil, nil)
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -1,17 +1,45 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"gopkg.in/jmcvetta/napping.v3"
 )
 
 func makeTrelloClient(token string) trelloClient {
+	return makeLoggedTrelloClient(context.Background(), log, token)
+}
+
+const LOGGERKEY contextKey = "logger"
+
+// ctxLogger is the logger of the webhook being handled, if there's one in
+// ctx, so its lines carry the correlation id. otherwise it's the global one.
+func ctxLogger(ctx context.Context) *zerolog.Logger {
+	if logger, ok := ctx.Value(LOGGERKEY).(zerolog.Logger); ok {
+		return &logger
+	}
+	return &log
+}
+
+// makeLoggedTrelloClient is like makeTrelloClient, but logs every call with
+// the given logger, so calls made while handling a webhook carry its
+// correlation id, and traces them as children of the span in ctx.
+func makeLoggedTrelloClient(ctx context.Context, logger zerolog.Logger, token string) trelloClient {
 	authvalues := (napping.Params{
 		"key":   s.TrelloApiKey,
 		"token": token,
@@ -25,50 +53,131 @@ func makeTrelloClient(token string) trelloClient {
 			Payload: data,
 			Result:  &res,
 		}
+		_, span := tracer.Start(ctx, "trello "+method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("http.method", strings.ToUpper(method)),
+				attribute.String("trello.path", strings.Split(strings.Replace(path, token, "<token>", -1), "?")[0]),
+			))
+
+		start := time.Now()
 		n, err := h.Send(request)
+		status := 0
+		if err == nil {
+			status = n.Status()
+		}
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		trelloLatency.WithLabelValues(method, strconv.Itoa(status)).
+			Observe(time.Since(start).Seconds())
+		logger.Debug().
+			Str("method", method).
+			Str("path", strings.Replace(path, token, "<token>", -1)).
+			Int("status", status).
+			Dur("took", time.Since(start)).
+			Msg("trello call")
 		if err != nil || n.Status() > 299 {
 			if err == nil {
-				err = fmt.Errorf("Trello returned %d for '%s': '%s'",
-					n.Status(), n.Url, n.RawText())
+				err = trelloError{n.Status(), n.Url, n.RawText()}
 			}
+			// the error has the token on its url, so it isn't recorded
+			span.SetStatus(codes.Error, "trello returned "+strconv.Itoa(status))
+			span.End()
 			return err
 		}
+		span.End()
 		return nil
 	}
 }
 
 type trelloClient func(string, string, interface{}, interface{}) error
 
-func userAllowed(trello trelloClient, userId, boardId, cardId string) bool {
-	// try admins cache
-	if s.RedisURL != "" {
-		v, err := rds.Get("admin:" + boardId + ":" + userId).Result()
-		if err == nil && v == "t" {
-			// the user is a board or team admin
-			return true
-		}
+type trelloError struct {
+	Status int
+	Url    string
+	Body   string
+}
+
+func (e trelloError) Error() string {
+	return fmt.Sprintf("Trello returned %d for '%s': '%s'", e.Status, e.Url, e.Body)
+}
+
+// trelloStatus returns the status code of a failed Trello call or 0 if the
+// call failed for some other reason.
+func trelloStatus(err error) int {
+	if terr, ok := err.(trelloError); ok {
+		return terr.Status
+	}
+	return 0
+}
+
+// resetErrorText describes why a reset failed in a way that can be shown to
+// users and sent elsewhere. trelloError has the token on its URL.
+func resetErrorText(err error) string {
+	if status := trelloStatus(err); status != 0 {
+		return fmt.Sprintf("Trello returned %d", status)
 	}
+	return "internal error"
+}
+
+func isUnauthorized(err error) bool {
+	return trelloStatus(err) == 401
+}
+
+func userAllowed(ctx context.Context, trello trelloClient, wh Webhook, settings BoardSettings) (allowed bool) {
+	userId := wh.Action.MemberCreator.Id
+	boardId := wh.Action.Data.Board.Id
+	cardId := wh.Action.Data.Card.Id
+
+	ctx, span := tracer.Start(ctx, "userAllowed", trace.WithAttributes(
+		attribute.String("user", userId),
+		attribute.String("action.type", wh.Action.Type),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Bool("allowed", allowed))
+		span.End()
+	}()
 
 	// check board and team admins
-	var br []Membership
-	err = trello("get", "/1/boards/"+boardId+"/memberships?member=false&orgMemberType=true", nil, &br)
+	br, err := boardMemberships(ctx, trello, boardId)
 	if err != nil {
-		log.Warn().Str("board", boardId).Err(err).Msg("failed to fetch memberships")
+		ctxLogger(ctx).Warn().Str("board", boardId).Err(err).Msg("failed to fetch memberships")
 		return false
 	}
 
+	isMember := false
+	var membership Membership
 	for _, ms := range br {
 		if ms.IdMember == userId {
 			if ms.MemberType == "admin" || ms.OrgMemberType == "admin" {
 				return true
+			}
+			isMember = true
+			membership = ms
+		}
+	}
 
-				go func() {
-					if s.RedisURL != "" {
-						rds.Set("admin:"+boardId+":"+userId, "t", time.Hour*2)
-					}
-				}()
+	// changes to who is on the board
+	switch wh.Action.Type {
+	case "removeMemberFromBoard":
+		// everybody can leave a board
+		return targetMember(wh) == userId
+	case "addMemberToBoard":
+		// normal members can invite others if the board allows it
+		if !isMember {
+			return false
+		}
+		var board Board
+		err = fetchBackupData(ctx, boardId, &board)
+		if err != nil || board.Prefs.Invitations == "" {
+			err = trello("get", "/1/boards/"+boardId+"?fields=prefs", nil, &board)
+			if err != nil {
+				ctxLogger(ctx).Warn().Str("board", boardId).Err(err).Msg("failed to fetch prefs")
+				return false
 			}
 		}
+		return board.Prefs.Invitations == "members"
+	case "makeAdminOfBoard", "makeNormalMemberOfBoard", "makeObserverOfBoard":
+		return false
 	}
 
 	// check card members
@@ -76,25 +185,140 @@ func userAllowed(trello trelloClient, userId, boardId, cardId string) bool {
 		// this action was dispatched by something other than a card action
 		return false
 	}
-	var cr []struct {
-		Id string `json:"id"`
+
+	// members removing themselves from cards
+	selfRemoval := wh.Action.Type == "removeMemberFromCard" && targetMember(wh) == userId
+	if selfRemoval {
+		switch settings.SelfRemoval {
+		case "always":
+			return true
+		case "never":
+			return false
+		}
 	}
 
-	err := trello("get", "/1/cards/"+cardId+"/members?fields=id", nil, &cr)
-	if err != nil {
-		log.Warn().Str("card", cardId).Err(err).
-			Msg("failed to fetch memberships")
+	kinds := cardChangeKinds(wh)
+
+	// the type of board member may restrict what this user can do
+	var policy MemberTypePolicy
+	if isMember && len(settings.MemberTypes) > 0 {
+		policy = settings.MemberTypes[memberType(ctx, membership, boardId)]
+	}
+	if policy.Only != nil && !allows(policy.Only, kinds) {
+		return false
+	}
+
+	// some kinds of changes to cards may be restricted to admins
+	for _, kind := range kinds {
+		if settings.allowed(kind) == ALLOWADMINS {
+			return false
+		}
+	}
+
+	// or allow it to do things on cards it isn't a member of
+	if policy.Anywhere != nil && allows(policy.Anywhere, kinds) {
+		return true
+	}
+
+	// only admins can delete cards
+	if wh.Action.Type == "deleteCard" {
+		return false
+	}
+
+	// check card members as they were before this action (trello already
+	// has them changed by it). our backup is only updated after the action
+	// is processed, so we use it and only ask trello when it isn't there.
+	// backups made from webhooks that don't tell the card members don't
+	// have the list at all, so we ask trello then too.
+	var backedCard struct {
+		Card
+		IdMembers *[]string `json:"idMembers"`
+	}
+	err = fetchBackupData(ctx, cardId, &backedCard)
+	hasBackup := err == nil
+
+	var idMembers []string
+	if hasBackup && backedCard.IdMembers != nil {
+		idMembers = *backedCard.IdMembers
 	} else {
-		for _, m := range cr {
-			if m.Id == userId {
-				return true
-			}
+		idMembers, err = cardMembers(ctx, trello, cardId)
+		if err != nil {
+			ctxLogger(ctx).Warn().Str("card", cardId).Err(err).
+				Msg("failed to fetch memberships")
+		}
+	}
+	for _, id := range idMembers {
+		if id == userId {
+			return true
 		}
 	}
 
+	// card creators can edit their cards as if they were members
+	if hasBackup && backedCard.IdMemberCreator != "" && backedCard.IdMemberCreator == userId {
+		return true
+	}
+
 	return false
 }
 
+func isBoardAdmin(ctx context.Context, trello trelloClient, userId, boardId string) bool {
+	br, err := boardMemberships(ctx, trello, boardId)
+	if err != nil {
+		ctxLogger(ctx).Warn().Str("board", boardId).Err(err).Msg("failed to fetch memberships")
+		return false
+	}
+
+	for _, ms := range br {
+		if ms.IdMember == userId {
+			return ms.MemberType == "admin" || ms.OrgMemberType == "admin"
+		}
+	}
+	return false
+}
+
+// memberType is "normal", "observer" or "guest" (board members that are not
+// part of the team that owns the board).
+func memberType(ctx context.Context, ms Membership, boardId string) string {
+	if ms.MemberType == "observer" {
+		return "observer"
+	}
+
+	if ms.OrgMemberType == "" {
+		var board Board
+		err := fetchBackupData(ctx, boardId, &board)
+		if err == nil && board.IdOrganization != "" {
+			return "guest"
+		}
+	}
+
+	return ms.MemberType
+}
+
+// targetMember is the member affected by an action that changes memberships.
+func targetMember(wh Webhook) string {
+	if wh.Action.Member.Id != "" {
+		return wh.Action.Member.Id
+	}
+	if wh.Action.Data.IdMemberAdded != "" {
+		return wh.Action.Data.IdMemberAdded
+	}
+	return wh.Action.Data.IdMember
+}
+
+// cardBackupData is the card as we back it up, with its list of members even
+// when it is empty. backups without the list don't know who is on the card.
+func cardBackupData(card Card) interface{} {
+	var data map[string]interface{}
+	j, _ := json.Marshal(card)
+	json.Unmarshal(j, &data)
+
+	if card.IdMembers == nil {
+		card.IdMembers = []string{}
+	}
+	data["idMembers"] = card.IdMembers
+	return data
+}
+
 func toJSONText(data interface{}) (v types.JSONText, err error) {
 	var x []byte
 	x, err = json.Marshal(data)
@@ -106,20 +330,24 @@ func toJSONText(data interface{}) (v types.JSONText, err error) {
 	return
 }
 
-func saveBackupData(boardId, id string, data interface{}) (err error) {
+func saveBackupData(ctx context.Context, boardId, id string, data interface{}) (err error) {
 	v, err := toJSONText(data)
 	if err != nil {
 		return
 	}
 
-	_, err = pg.Exec(`
+	defer observeBackupWrite(time.Now())
+	span := backupSpan(ctx, "save", id)
+	defer func() { endSpan(span, err) }()
+
+	_, err = pg.ExecContext(ctx, `
 INSERT INTO backups (id, board, data) VALUES ($1, $2, $3)
 ON CONFLICT (id) DO UPDATE SET board = $2, data = backups.data || $3
     `, id, boardId, v)
 	return
 }
 
-func updateBackupData(
+func updateBackupData(ctx context.Context,
 	boardId, id string, initData interface{},
 	initialize, updatefun string, value interface{},
 ) (err error) {
@@ -141,7 +369,11 @@ func updateBackupData(
 		strings.Replace(initialize, "$init", "$3", -1),
 		"$arg", "$4", -1)
 
-	_, err = pg.Exec(`
+	defer observeBackupWrite(time.Now())
+	span := backupSpan(ctx, "update", id)
+	defer func() { endSpan(span, err) }()
+
+	_, err = pg.ExecContext(ctx, `
 WITH
 init AS (
   SELECT (`+initialize+`) AS data
@@ -164,11 +396,34 @@ INSERT INTO backups (id, board, data) VALUES ($1, $2, (SELECT data FROM new))
 	return
 }
 
-func fetchBackupData(id string, data interface{}) (err error) {
+// withPqFields adds the details postgres gives about an error to a log event.
+func withPqFields(event *zerolog.Event, err error) *zerolog.Event {
+	if perr, ok := err.(*pq.Error); ok {
+		event = event.
+			Str("pq_code", string(perr.Code)).
+			Str("pq_detail", perr.Detail).
+			Str("pq_hint", perr.Hint).
+			Str("pq_where", perr.Where)
+	}
+	return event
+}
+
+func observeBackupWrite(start time.Time) {
+	backupWriteLatency.Observe(time.Since(start).Seconds())
+}
+
+func fetchBackupData(ctx context.Context, id string, data interface{}) (err error) {
 	var wrapper struct {
 		Data types.JSONText `db:"data"`
 	}
-	err = pg.Get(&wrapper, `SELECT data FROM backups WHERE id = $1`, id)
+	span := backupSpan(ctx, "fetch", id)
+	err = pg.GetContext(ctx, &wrapper, `SELECT data FROM backups WHERE id = $1`, id)
+	span.SetAttributes(attribute.Bool("backup.found", err == nil))
+	if err == sql.ErrNoRows {
+		span.End()
+		return
+	}
+	endSpan(span, err)
 
 	if err != nil {
 		return
@@ -178,13 +433,19 @@ func fetchBackupData(id string, data interface{}) (err error) {
 	return
 }
 
-func deleteBackupData(boardId, id string) (err error) {
-	_, err = pg.Exec(`DELETE FROM backups WHERE id = $1 AND board = $2`, id, boardId)
+func deleteBackupData(ctx context.Context, boardId, id string) (err error) {
+	span := backupSpan(ctx, "delete", id)
+	defer func() { endSpan(span, err) }()
+
+	_, err = pg.ExecContext(ctx, `DELETE FROM backups WHERE id = $1 AND board = $2`, id, boardId)
 	return
 }
 
-func itemJustConvertedIntoCard(cardName, parentChecklistId string) (id string, err error) {
-	err = pg.Get(&id, `
+func itemJustConvertedIntoCard(ctx context.Context, cardName, parentChecklistId string) (id string, err error) {
+	span := backupSpan(ctx, "find converted checkItem", parentChecklistId)
+	defer func() { endSpan(span, err) }()
+
+	err = pg.GetContext(ctx, &id, `
 WITH
 potential_checkitems AS (
   SELECT id, data->'id' AS json_id FROM backups
@@ -206,3 +467,37 @@ func attachmentIsUploaded(attachment Attachment) bool {
 	attHost := strings.Split(attachment.Url, "/")[2]
 	return attHost == "trello-attachments.s3.amazonaws.com"
 }
+
+// describeAction makes a short description of an action, like
+// `update card (name, desc) "Something"`.
+func describeAction(wh Webhook) string {
+	var words []string
+	last := 0
+	for i, r := range wh.Action.Type {
+		if unicode.IsUpper(r) {
+			words = append(words, strings.ToLower(wh.Action.Type[last:i]))
+			last = i
+		}
+	}
+	words = append(words, strings.ToLower(wh.Action.Type[last:]))
+	description := strings.Join(words, " ")
+
+	if len(wh.Action.Data.Old) > 0 {
+		var changed []string
+		for changedKey := range wh.Action.Data.Old {
+			changed = append(changed, changedKey)
+		}
+		sort.Strings(changed)
+		description += " (" + strings.Join(changed, ", ") + ")"
+	}
+
+	if wh.Action.Data.Card.Name != "" {
+		description += ` "` + wh.Action.Data.Card.Name + `"`
+	} else if wh.Action.Data.List.Name != "" {
+		description += ` "` + wh.Action.Data.List.Name + `"`
+	} else if wh.Action.Data.Label.Name != "" {
+		description += ` "` + wh.Action.Data.Label.Name + `"`
+	}
+
+	return description
+}
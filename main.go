@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"permissionsfortrello/public"
 	"permissionsfortrello/tmpl"
+	"syscall"
 	"time"
 
 	"github.com/arschles/go-bindata-html-template"
@@ -18,6 +21,7 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/minio/minio-go"
 	"github.com/mrjones/oauth"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"gopkg.in/redis.v5"
 )
@@ -33,6 +37,21 @@ type Settings struct {
 	AWSKeyId        string `envconfig:"AWS_KEY_ID" required:"true"`
 	AWSSecretKey    string `envconfig:"AWS_SECRET_KEY" required:"true"`
 	S3BucketName    string `envconfig:"S3_BUCKET_NAME" required:"true"`
+	TokenKeyFile    string `envconfig:"TOKEN_KEY_FILE"`
+	SMTPHost        string `envconfig:"SMTP_HOST"`
+	SMTPPort        string `envconfig:"SMTP_PORT" default:"25"`
+	SMTPUser        string `envconfig:"SMTP_USER"`
+	SMTPPassword    string `envconfig:"SMTP_PASSWORD"`
+	SMTPFrom        string `envconfig:"SMTP_FROM" default:"permissions@localhost"`
+
+	HealthCheckInterval time.Duration `envconfig:"HEALTH_CHECK_INTERVAL" default:"1h"`
+	ShutdownTimeout     time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+
+	OTLPEndpoint string `envconfig:"OTLP_ENDPOINT"` // like "localhost:4318", traces go to stdout when empty
+	OTLPInsecure bool   `envconfig:"OTLP_INSECURE"`
+
+	LogLevel  string `envconfig:"LOG_LEVEL" default:"debug"`
+	LogFormat string `envconfig:"LOG_FORMAT" default:"console"` // or "json"
 }
 
 var err error
@@ -46,8 +65,11 @@ var router *mux.Router
 var schema graphql.Schema
 var log = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
 var parsedtemplates struct {
-	index   *template.Template
-	account *template.Template
+	index     *template.Template
+	account   *template.Template
+	approvals *template.Template
+	deleted   *template.Template
+	board     *template.Template
 }
 
 func main() {
@@ -56,9 +78,27 @@ func main() {
 		log.Fatal().Err(err).Msg("couldn't process envconfig.")
 	}
 
-	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	var level zerolog.Level
+	level, err = zerolog.ParseLevel(s.LogLevel)
+	if err != nil {
+		log.Fatal().Err(err).Str("level", s.LogLevel).Msg("invalid log level.")
+	}
+	zerolog.SetGlobalLevel(level)
+	switch s.LogFormat {
+	case "json":
+		log = zerolog.New(os.Stderr)
+	case "console":
+	default:
+		log.Fatal().Str("format", s.LogFormat).Msg("invalid log format, use 'console' or 'json'.")
+	}
 	log = log.With().Timestamp().Logger()
 
+	// keys used to encrypt trello tokens
+	err = loadTokenKeys()
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't load token keys.")
+	}
+
 	// cookie store
 	store = sessions.NewCookieStore([]byte(s.SecretKey))
 
@@ -73,6 +113,9 @@ func main() {
 	// templates
 	parsedtemplates.index = template.Must(template.New("index", tmpl.Asset).Parse("templates/index.html"))
 	parsedtemplates.account = template.Must(template.New("account", tmpl.Asset).Parse("templates/account.html"))
+	parsedtemplates.approvals = template.Must(template.New("approvals", tmpl.Asset).Parse("templates/approvals.html"))
+	parsedtemplates.deleted = template.Must(template.New("deleted", tmpl.Asset).Parse("templates/deleted.html"))
+	parsedtemplates.board = template.Must(template.New("board", tmpl.Asset).Parse("templates/board.html"))
 
 	// oauth consumer
 	c = oauth.NewConsumer(
@@ -94,6 +137,12 @@ func main() {
 		log.Fatal().Err(err).Msg("couldn't connect to postgres")
 	}
 
+	// graphql schema
+	err = buildSchema()
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't build graphql schema.")
+	}
+
 	// redis connection
 	if s.RedisURL != "" {
 		rurl, _ := url.Parse(s.RedisURL)
@@ -109,6 +158,22 @@ func main() {
 		}
 	}
 
+	// commands, see cli.go
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		err = runCommand(os.Args[1:])
+		if err != nil {
+			log.Fatal().Err(err).Msg("command failed.")
+		}
+		return
+	}
+
+	// tracing
+	var stopTracing func(context.Context) error
+	stopTracing, err = startTracing()
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't start tracing.")
+	}
+
 	// public http assets
 	httpPublic := &assetfs.AssetFS{Asset: public.Asset, AssetDir: public.AssetDir, Prefix: "public"}
 
@@ -120,6 +185,24 @@ func main() {
 	router.Path("/auth/callback").Methods("GET").HandlerFunc(TrelloAuthCallback)
 	router.Path("/account").Methods("GET").HandlerFunc(ServeAccount)
 	router.Path("/setBoard").Methods("POST").HandlerFunc(handleSetupBoard)
+	router.Path("/approvals").Methods("GET").HandlerFunc(ServeApprovals)
+	router.Path("/approvals/{id}").Methods("POST").HandlerFunc(handleApproval)
+	router.Path("/boards/{id}").Methods("GET").HandlerFunc(ServeBoard)
+	router.Path("/boards/{id}/backup").Methods("POST").HandlerFunc(handleBoardBackup)
+	router.Path("/deleted").Methods("GET").HandlerFunc(ServeDeleted)
+	router.Path("/deleted/{board}/{card}").Methods("POST").HandlerFunc(handleRestoreDeleted)
+	router.Path("/apiKeys").Methods("POST").HandlerFunc(handleCreateApiKey)
+	router.Path("/apiKeys/{id}/delete").Methods("POST").HandlerFunc(handleDeleteApiKey)
+	router.Path("/api/v1/boards").Methods("GET").HandlerFunc(apiListBoards)
+	router.Path("/api/v1/boards/{id}").Methods("PUT").HandlerFunc(apiSetupBoard)
+	router.Path("/api/v1/boards/{id}/settings").Methods("GET").HandlerFunc(apiGetSettings)
+	router.Path("/api/v1/boards/{id}/settings").Methods("PUT").HandlerFunc(apiSetSettings)
+	router.Path("/api/v1/boards/{id}/backups/{objectId}").Methods("GET").HandlerFunc(apiGetBackup)
+	router.Path("/api/v1/boards/{id}/restore").Methods("POST").HandlerFunc(apiRestore)
+	router.Path("/graphql").Methods("GET", "POST").HandlerFunc(handleGraphQL)
+	router.Path("/healthz").Methods("GET").HandlerFunc(serveHealthz)
+	router.Path("/readyz").Methods("GET").HandlerFunc(serveReadyz)
+	router.Path("/metrics").Methods("GET").Handler(promhttp.Handler())
 	router.Path("/_/webhooks/board").Methods("HEAD").HandlerFunc(returnOk)
 	router.Path("/_/webhooks/board").Methods("POST").HandlerFunc(handleWebhook)
 	router.PathPrefix("/public/").Methods("GET").Handler(http.FileServer(httpPublic))
@@ -132,6 +215,12 @@ func main() {
 			return
 		})
 
+	// periodically check tokens and webhooks
+	go startHealthChecks()
+
+	// send digests of reverted changes
+	go startNotifier()
+
 	// start the server
 	srv := &http.Server{
 		Handler:      router,
@@ -139,6 +228,31 @@ func main() {
 		WriteTimeout: 25 * time.Second,
 		ReadTimeout:  25 * time.Second,
 	}
+
+	// on SIGTERM stop taking webhooks and let the resets in progress finish
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sigs
+		log.Info().Str("signal", sig.String()).Msg("shutting down.")
+
+		if !drainResets(s.ShutdownTimeout) {
+			log.Warn().Msg("resets still in progress, exiting anyway.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		srv.Shutdown(ctx)
+		stopTracing(ctx)
+		close(stopped)
+	}()
+
 	log.Info().Str("port", s.Port).Msg("listening.")
-	srv.ListenAndServe()
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal().Err(err).Msg("server failed.")
+	}
+	<-stopped
+	log.Info().Msg("bye.")
 }
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+
+	"github.com/jmoiron/sqlx/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func setupBoard(boardId, userId, email, token string, enabled bool) (err error) {
@@ -31,17 +37,34 @@ func setupBoard(boardId, userId, email, token string, enabled bool) (err error)
 
 proceed:
 	if enabled {
-		// create board webhook
-		var webhook struct {
-			Id string `json:"id"`
+		// tokens are only stored encrypted
+		var sealed string
+		sealed, err = sealToken(token)
+		if err != nil {
+			log.Warn().Err(err).Str("board", boardId).
+				Msg("failed to encrypt token")
+			return err
 		}
-		err = trello("put", "/1/webhooks", struct {
-			CallbackURL string `json:"callbackURL"`
-			IdModel     string `json:"idModel"`
-		}{s.Host + "/_/webhooks/board", boardId}, &webhook)
+
+		// if the board was already enabled (by this or by another admin) we just
+		// attach this token to it, so it can be used when the others fail
+		var alreadyEnabled bool
+		err = pg.Get(&alreadyEnabled, `
+SELECT EXISTS (SELECT 1 FROM boards WHERE id = $1)
+    `, boardId)
 		if err != nil {
 			log.Warn().Err(err).Str("board", boardId).
-				Msg("failed to create board webhook")
+				Msg("failed to check if board is enabled")
+			return err
+		}
+		if alreadyEnabled {
+			return attachToken(boardId, userId, email, sealed)
+		}
+
+		// create board webhook
+		var webhookId string
+		webhookId, err = createWebhook(trello, boardId)
+		if err != nil {
 			return err
 		}
 
@@ -49,15 +72,20 @@ proceed:
 		_, err = pg.Exec(`
 INSERT INTO boards (id, token, email, webhook_id)
 VALUES ($1, $2, $3, $4)
-    `, boardId, token, email, webhook.Id)
+    `, boardId, sealed, email, webhookId)
 		if err != nil {
 			log.Warn().Err(err).Str("board", boardId).
 				Msg("failed to set board")
 			return err
 		}
 
+		err = attachToken(boardId, userId, email, sealed)
+		if err != nil {
+			return err
+		}
+
 		// perform initial backup
-		err = initialBackup(boardId, token)
+		err = initialBackup(boardId, sealed)
 		if err != nil {
 			return err
 		}
@@ -86,7 +114,14 @@ SELECT * FROM wd
 		}
 
 		// delete the board webhook
-		trello = makeTrelloClient(wd.PreviousToken)
+		var previousToken string
+		previousToken, err = openToken(wd.PreviousToken)
+		if err != nil {
+			log.Warn().Err(err).Str("board", boardId).
+				Msg("failed to decrypt previous token")
+			return nil
+		}
+		trello = makeTrelloClient(previousToken)
 		err = trello("delete", "/1/webhooks/"+wd.WebhookId, nil, nil)
 		if err != nil {
 			log.Warn().Err(err).Str("board", boardId).
@@ -97,3 +132,206 @@ SELECT * FROM wd
 
 	return nil
 }
+
+// adminBoards returns all open boards for which the user is an admin.
+func adminBoards(trello trelloClient, username string) (boards []Board, err error) {
+	var allboards []Board
+	err = trello("get",
+		"/1/members/"+username+
+			"/boards?filter=open&fields=id,shortLink,name,memberships&memberships=me",
+		nil, &allboards)
+	if err != nil {
+		return
+	}
+
+	for _, board := range allboards {
+		m := board.Memberships[0]
+		if m.MemberType == "admin" || m.OrgMemberType == "admin" {
+			boards = append(boards, board)
+		}
+	}
+	return
+}
+
+func createWebhook(trello trelloClient, boardId string) (id string, err error) {
+	var webhook struct {
+		Id string `json:"id"`
+	}
+	err = trello("put", "/1/webhooks", struct {
+		CallbackURL string `json:"callbackURL"`
+		IdModel     string `json:"idModel"`
+	}{s.Host + "/_/webhooks/board", boardId}, &webhook)
+	if err != nil {
+		log.Warn().Err(err).Str("board", boardId).
+			Msg("failed to create board webhook")
+		return
+	}
+	return webhook.Id, nil
+}
+
+func attachToken(boardId, userId, email, sealed string) (err error) {
+	_, err = pg.Exec(`
+WITH
+previous AS (
+  SELECT token FROM tokens
+  WHERE board = $1 AND member = $2
+),
+tk AS (
+  INSERT INTO tokens (board, member, email, token)
+  VALUES ($1, $2, $3, $4)
+  ON CONFLICT (board, member) DO UPDATE
+    SET email = $3, token = $4, valid = true
+)
+UPDATE boards SET token = $4, degraded = false
+WHERE id = $1 AND (degraded OR token = (SELECT token FROM previous))
+    `, boardId, userId, email, sealed)
+	if err != nil {
+		log.Warn().Err(err).Str("board", boardId).Str("user", userId).
+			Msg("failed to attach token to board")
+	}
+	return
+}
+
+// tokenLost tells if the token was revoked or can't access the board
+// anymore. a 401 on some other call may just mean the token can't reach that
+// one object, which is no reason to stop using it.
+func tokenLost(token, boardId string) bool {
+	trello := makeTrelloClient(token)
+	err := trello("get", "/1/tokens/"+token+"?fields=id", nil, nil)
+	if err == nil {
+		err = trello("get", "/1/boards/"+boardId+"?fields=id", nil, nil)
+	}
+	status := trelloStatus(err)
+	return status == 401 || status == 404
+}
+
+// failoverToken marks the given token as invalid and makes the next valid
+// token attached to the board the one used on resets.
+// returns sql.ErrNoRows when there are no valid tokens left.
+func failoverToken(boardId, failed string) (next string, err error) {
+	err = pg.Get(&next, `
+WITH
+invalidated AS (
+  UPDATE tokens SET valid = false
+  WHERE board = $1 AND token = $2
+),
+nexttoken AS (
+  SELECT token FROM tokens
+  WHERE board = $1 AND valid AND token != $2
+  LIMIT 1
+)
+UPDATE boards SET token = (SELECT token FROM nexttoken)
+WHERE id = $1 AND EXISTS (SELECT 1 FROM nexttoken)
+RETURNING token
+    `, boardId, failed)
+	return
+}
+
+// degradeBoard flags a board as having no valid tokens and emails its admins
+// so one of them can come back and attach a new one.
+func degradeBoard(boardId string) (err error) {
+	var emails []string
+	err = pg.Select(&emails, `
+WITH
+degraded AS (
+  UPDATE boards SET degraded = true
+  WHERE id = $1 AND NOT degraded
+  RETURNING email
+)
+SELECT email FROM degraded
+UNION
+SELECT tokens.email FROM tokens
+WHERE board = $1 AND EXISTS (SELECT 1 FROM degraded)
+    `, boardId)
+	if err != nil {
+		return
+	}
+	if len(emails) == 0 {
+		// already degraded, admins were notified before
+		return
+	}
+
+	return sendEmail(emails,
+		"Permissions for Trello stopped working on one of your boards",
+		`Hello,
+
+We can't access the Trello board https://trello.com/b/`+boardId+` anymore:
+all the tokens we had for it were revoked or lost access to the board.
+
+Until a board admin enables Permissions on it again at `+s.Host+`/account,
+unauthorized changes will not be reverted.
+`)
+}
+
+// restoreCard recreates a card that was deleted from the board using its
+// backup, the same way an unallowed deletion is reverted.
+func restoreCard(boardId, cardId, username string) (err error) {
+	ctx, span := tracer.Start(context.Background(), "restoreCard", trace.WithAttributes(
+		attribute.String("board", boardId),
+		attribute.String("card", cardId),
+	))
+	defer func() { endSpan(span, err) }()
+
+	var token string
+	err = pg.Get(&token, `SELECT token FROM boards WHERE id = $1`, boardId)
+	if err == sql.ErrNoRows {
+		return errors.New("board is not enabled.")
+	} else if err != nil {
+		return
+	}
+
+	var data types.JSONText
+	err = pg.Get(&data, `
+SELECT data FROM backups
+WHERE id = $1 AND board = $2 AND deleted_at IS NOT NULL
+    `, cardId, boardId)
+	if err == sql.ErrNoRows {
+		return errors.New("deleted card not found on backups.")
+	} else if err != nil {
+		return
+	}
+	var card Card
+	data.Unmarshal(&card)
+
+	plaintoken, err := openToken(token)
+	if err != nil {
+		return
+	}
+	err = makeLoggedTrelloClient(ctx, log, plaintoken)("get", "/1/cards/"+cardId+"?fields=id", nil, nil)
+	if err == nil {
+		return errors.New("card still exists.")
+	} else if trelloStatus(err) != 404 {
+		return
+	}
+
+	return onUnallowed(ctx, log.With().Str("board", boardId).Logger(), token, Webhook{
+		Action: Action{
+			Type: "deleteCard",
+			Data: Data{
+				Board: Board{Id: boardId},
+				List:  List{Id: card.IdList},
+				Card:  Card{Id: cardId},
+			},
+			MemberCreator: User{Username: username},
+		},
+	})
+}
+
+func saveBoardSettings(boardId string, settings BoardSettings) (err error) {
+	err = settings.validate()
+	if err != nil {
+		return
+	}
+
+	res, err := pg.Exec(`
+UPDATE boards SET settings = $2
+WHERE id = $1
+    `, boardId, settings)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("board is not enabled.")
+	}
+	return
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	webhooksReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "permissions_webhooks_received_total",
+		Help: "Trello webhooks received, by action type.",
+	}, []string{"type"})
+
+	resetOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "permissions_actions_total",
+		Help: "Processed actions, by outcome (allowed, reverted or failed).",
+	}, []string{"outcome"})
+
+	resetFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "permissions_reset_failures_total",
+		Help: "Resets that failed, by the status code Trello returned (0 when it wasn't Trello).",
+	}, []string{"status"})
+
+	resetsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "permissions_resets_in_flight",
+		Help: "Actions currently being checked or reverted.",
+	})
+
+	trelloLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "permissions_trello_request_duration_seconds",
+		Help:    "Latency of Trello API calls, by method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "status"})
+
+	backupWriteLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "permissions_backup_write_duration_seconds",
+		Help:    "Latency of writes to the backups table.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	s3Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "permissions_s3_bytes_total",
+		Help: "Bytes of attachments transferred to and from S3, by direction.",
+	}, []string{"direction"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		webhooksReceived,
+		resetOutcomes,
+		resetFailures,
+		resetsInFlight,
+		trelloLatency,
+		backupWriteLatency,
+		s3Bytes,
+	)
+}
+
+// action types we know what to do with. anyone can POST to the webhook
+// endpoint, so other types are counted together instead of creating a new
+// series for each.
+var metricActionTypes = map[string]bool{
+	"addAttachmentToCard":        true,
+	"addChecklistToCard":         true,
+	"addLabelToCard":             true,
+	"addMemberToBoard":           true,
+	"addMemberToCard":            true,
+	"commentCard":                true,
+	"convertToCardFromCheckItem": true,
+	"copyCard":                   true,
+	"createCard":                 true,
+	"createCheckItem":            true,
+	"createLabel":                true,
+	"createList":                 true,
+	"deleteAttachmentFromCard":   true,
+	"deleteCard":                 true,
+	"deleteCheckItem":            true,
+	"deleteComment":              true,
+	"deleteLabel":                true,
+	"makeAdminOfBoard":           true,
+	"makeNormalMemberOfBoard":    true,
+	"makeObserverOfBoard":        true,
+	"moveCardFromBoard":          true,
+	"moveCardToBoard":            true,
+	"moveListFromBoard":          true,
+	"moveListToBoard":            true,
+	"removeChecklistFromCard":    true,
+	"removeLabelFromCard":        true,
+	"removeMemberFromBoard":      true,
+	"removeMemberFromCard":       true,
+	"updateBoard":                true,
+	"updateCard":                 true,
+	"updateCheckItem":            true,
+	"updateCheckItemStateOnCard": true,
+	"updateChecklist":            true,
+	"updateComment":              true,
+	"updateCustomFieldItem":      true,
+	"updateLabel":                true,
+	"updateList":                 true,
+}
+
+func metricActionType(actionType string) string {
+	if metricActionTypes[actionType] {
+		return actionType
+	}
+	return "other"
+}
+
+func countResetFailure(err error) {
+	resetOutcomes.WithLabelValues("failed").Inc()
+	resetFailures.WithLabelValues(strconv.Itoa(trelloStatus(err))).Inc()
+}
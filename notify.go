@@ -0,0 +1,154 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+)
+
+// reverts are kept to be shown on the board page for this long
+const REVERTSRETENTION = time.Hour * 24 * 90
+
+type Revert struct {
+	Id         int            `db:"id"`
+	Board      string         `db:"board"`
+	Webhook    types.JSONText `db:"webhook"`
+	Error      string         `db:"error"`
+	CreatedAt  time.Time      `db:"created_at"`
+	NotifiedAt pq.NullTime    `db:"notified_at"`
+}
+
+// recordRevert keeps a reverted change to be shown on the board page and
+// sent on the next digest. when the board doesn't want to be notified it is
+// stored as already notified, so the digests don't pick it up later.
+func recordRevert(boardId string, wh Webhook, reseterr error, notify bool) (err error) {
+	v, err := toJSONText(wh)
+	if err != nil {
+		return
+	}
+
+	var errText string
+	if reseterr != nil {
+		errText = resetErrorText(reseterr)
+	}
+
+	_, err = pg.Exec(`
+INSERT INTO reverts (board, webhook, error, notified_at)
+VALUES ($1, $2, $3, CASE WHEN $4 THEN NULL ELSE now() END)
+    `, boardId, v, errText, notify)
+	return
+}
+
+// startNotifier sends the hourly and daily digests of reverted changes.
+func startNotifier() {
+	for {
+		var boardIds []string
+		err := pg.Select(&boardIds, `
+SELECT reverts.board FROM reverts
+INNER JOIN boards ON boards.id = reverts.board
+WHERE notified_at IS NULL
+  AND boards.settings->>'notify' IN ('hourly', 'daily')
+GROUP BY reverts.board, boards.settings
+HAVING min(reverts.created_at) < now() - CASE boards.settings->>'notify'
+  WHEN 'hourly' THEN interval '1 hour'
+  ELSE interval '1 day'
+END
+        `)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to fetch boards to notify")
+		}
+
+		for _, boardId := range boardIds {
+			// don't get cut off in the middle of it when shutting down
+			startWork()
+			err = sendRevertsDigest(boardId)
+			finishWork()
+			if err != nil {
+				log.Warn().Err(err).Str("board", boardId).
+					Msg("failed to send reverts digest")
+			}
+		}
+
+		time.Sleep(time.Minute * 5)
+	}
+}
+
+// sendRevertsDigest emails the board admins a list of all reverted changes
+// they weren't notified about yet.
+func sendRevertsDigest(boardId string) (err error) {
+	var reverts []Revert
+	err = pg.Select(&reverts, `
+UPDATE reverts SET notified_at = now()
+WHERE board = $1 AND notified_at IS NULL
+RETURNING *
+    `, boardId)
+	if err != nil || len(reverts) == 0 {
+		return
+	}
+
+	var emails []string
+	err = pg.Select(&emails, `
+SELECT email FROM boards WHERE id = $1
+UNION
+SELECT email FROM tokens WHERE board = $1
+    `, boardId)
+	if err != nil {
+		return
+	}
+
+	var boardName string
+	body := ""
+	for _, revert := range reverts {
+		var wh Webhook
+		revert.Webhook.Unmarshal(&wh)
+		if wh.Action.Data.Board.Name != "" {
+			boardName = wh.Action.Data.Board.Name
+		}
+
+		link := "https://trello.com/b/" + boardId
+		if wh.Action.Data.Card.ShortLink != "" {
+			link = "https://trello.com/c/" + wh.Action.Data.Card.ShortLink
+		}
+
+		body += "- " + revert.CreatedAt.Format(PRETTYDATEFORMAT) + ": " +
+			wh.Action.MemberCreator.Username + " tried to " + describeAction(wh) +
+			"\n  " + link + "\n"
+		if revert.Error != "" {
+			body += "  (we failed to revert this one: " + revert.Error + ")\n"
+		}
+	}
+
+	subject := "Changes reverted on Trello"
+	if boardName != "" {
+		subject += " (" + boardName + ")"
+	}
+
+	err = sendEmail(emails, subject, `Hello,
+
+These changes were made by people who weren't allowed to and were reverted:
+
+`+body)
+	if err != nil {
+		// try again later
+		ids := make([]int64, len(reverts))
+		for i, revert := range reverts {
+			ids[i] = int64(revert.Id)
+		}
+		pg.Exec(`
+UPDATE reverts SET notified_at = NULL
+WHERE id = ANY ($1)
+        `, pq.Array(ids))
+	}
+	return
+}
+
+// purgeReverts deletes old reverts. even daily digests are sent long before
+// they're purged.
+func purgeReverts() (err error) {
+	_, err = pg.Exec(`
+DELETE FROM reverts
+WHERE created_at < now() - make_interval(secs => $1)
+    `, REVERTSRETENTION.Seconds())
+	return
+}
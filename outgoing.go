@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const OUTGOINGMAXATTEMPTS = 6
+
+// board admins choose where we POST to, so we must not let them reach
+// anything on our own network. the address is checked again when dialing
+// because the name may resolve to something else by then.
+var outgoingClient = &http.Client{
+	Timeout: time.Second * 10,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: time.Second * 5,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if !publicIP(net.ParseIP(host)) {
+					return errors.New("refusing to connect to " + host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: time.Second * 5,
+	},
+}
+
+// OutgoingWebhook is a URL to which we send an Event for every action we
+// process on a board.
+type OutgoingWebhook struct {
+	URL string `json:"url"`
+
+	// when set, the body is signed with HMAC-SHA256 and sent on the
+	// X-Permissions-Signature header as "sha256=<hex>"
+	Secret string `json:"secret,omitempty"`
+
+	// send Slack-compatible messages instead of events
+	Slack bool `json:"slack,omitempty"`
+}
+
+type Event struct {
+	Id          string  `json:"id"`
+	Date        string  `json:"date"`
+	Board       IdName  `json:"board"`
+	Card        *IdName `json:"card,omitempty"`
+	User        User    `json:"user"`
+	Action      string  `json:"action"`
+	Description string  `json:"description"`
+	Verdict     string  `json:"verdict"`         // "allowed" or "reverted"
+	Error       string  `json:"error,omitempty"` // like "Trello returned 403"
+}
+
+// emitEvent sends the event to all the board's outgoing webhooks, in the
+// background.
+func emitEvent(logger zerolog.Logger, board Board, wh Webhook, verdict string, reseterr error) {
+	if len(board.Settings.Webhooks) == 0 {
+		return
+	}
+
+	event := Event{
+		Id:          wh.Action.Id,
+		Date:        wh.Action.Date,
+		Board:       IdName{wh.Action.Data.Board.Id, wh.Action.Data.Board.Name},
+		User:        wh.Action.MemberCreator,
+		Action:      wh.Action.Type,
+		Description: describeAction(wh),
+		Verdict:     verdict,
+	}
+	if wh.Action.Data.Card.Id != "" {
+		event.Card = &IdName{wh.Action.Data.Card.Id, wh.Action.Data.Card.Name}
+	}
+	if reseterr != nil {
+		event.Error = resetErrorText(reseterr)
+	}
+
+	for _, target := range board.Settings.Webhooks {
+		target := target
+		goBackground(func() { deliverEvent(logger, target, event) })
+	}
+}
+
+func deliverEvent(logger zerolog.Logger, target OutgoingWebhook, event Event) {
+	logger = logger.With().Str("url", target.URL).Logger()
+
+	var payload interface{} = event
+	if target.Slack {
+		payload = slackMessage(event)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to encode event")
+		return
+	}
+
+	var signature string
+	if target.Secret != "" {
+		signature = signEvent(target.Secret, body)
+	}
+
+	for attempt := 0; attempt < OUTGOINGMAXATTEMPTS; attempt++ {
+		if attempt > 0 {
+			if isDraining() {
+				// we're shutting down, can't wait for it
+				break
+			}
+			// 2s, 4s, 8s...
+			time.Sleep(time.Second << uint(attempt))
+		}
+
+		req, err := http.NewRequest("POST", target.URL, bytes.NewReader(body))
+		if err != nil {
+			logger.Warn().Err(err).Msg("invalid outgoing webhook")
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if signature != "" {
+			req.Header.Set("X-Permissions-Signature", signature)
+		}
+
+		resp, err := outgoingClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("%s returned %d", target.URL, resp.StatusCode)
+			if resp.StatusCode < 500 && resp.StatusCode != 429 {
+				// no use in trying again
+				logger.Warn().Err(err).Msg("outgoing webhook refused")
+				return
+			}
+		}
+
+		logger.Debug().Err(err).Int("attempt", attempt).Msg("failed to deliver event")
+	}
+
+	logger.Warn().Msg("giving up on delivering event")
+}
+
+// signEvent is the value of the X-Permissions-Signature header.
+func signEvent(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateOutgoingURL only accepts http(s) URLs to hosts on the internet.
+func validateOutgoingURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return errors.New("invalid webhook url: " + raw)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("webhook url must be http or https: " + raw)
+	}
+	if u.Hostname() == "" {
+		return errors.New("webhook url has no host: " + raw)
+	}
+
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return errors.New("can't resolve webhook host: " + u.Hostname())
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return errors.New("webhook url must point to a public address: " + raw)
+		}
+	}
+	return nil
+}
+
+func publicIP(ip net.IP) bool {
+	return ip != nil &&
+		!ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsUnspecified()
+}
+
+func slackMessage(event Event) interface{} {
+	verb := "was allowed to"
+	if event.Verdict == "reverted" {
+		verb = "wasn't allowed to"
+	}
+
+	text := fmt.Sprintf("*%s* %s %s on <https://trello.com/b/%s|%s>",
+		event.User.Username, verb, event.Description, event.Board.Id, event.Board.Name)
+	if event.Verdict == "reverted" {
+		if event.Error != "" {
+			text += ". We failed to revert it: " + event.Error
+		} else {
+			text += ", so it was reverted."
+		}
+	}
+
+	return struct {
+		Text string `json:"text"`
+	}{text}
+}
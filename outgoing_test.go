@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSignEvent(t *testing.T) {
+	for _, test := range []struct {
+		secret    string
+		body      string
+		signature string
+	}{
+		// from RFC 4231, test case 2
+		{"Jefe", "what do ya want for nothing?",
+			"sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"key", "The quick brown fox jumps over the lazy dog",
+			"sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+	} {
+		if got := signEvent(test.secret, []byte(test.body)); got != test.signature {
+			t.Errorf("signEvent(%q, %q) = %s, want %s",
+				test.secret, test.body, got, test.signature)
+		}
+	}
+}
+
+func TestValidateOutgoingURL(t *testing.T) {
+	for _, test := range []struct {
+		url   string
+		valid bool
+	}{
+		{"https://8.8.8.8/hook", true},
+		{"http://1.1.1.1:8080/hook?x=y", true},
+		{"https://[2606:4700:4700::1111]/hook", true},
+		{"ftp://8.8.8.8/hook", false},
+		{"8.8.8.8/hook", false},
+		{"https:///hook", false},
+		{"https://127.0.0.1/hook", false},
+		{"https://localhost/hook", false},
+		{"http://10.0.0.1/hook", false},
+		{"http://192.168.1.10/hook", false},
+		{"http://172.16.0.1/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://0.0.0.0/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://[fd00::1]/hook", false},
+		{"http://%zz/hook", false},
+	} {
+		if err := validateOutgoingURL(test.url); (err == nil) != test.valid {
+			t.Errorf("validateOutgoingURL(%q) = %v, want valid %v", test.url, err, test.valid)
+		}
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	for _, test := range []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.31.255.255", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+	} {
+		if got := publicIP(net.ParseIP(test.ip)); got != test.public {
+			t.Errorf("publicIP(%s) = %v, want %v", test.ip, got, test.public)
+		}
+	}
+	if publicIP(nil) {
+		t.Error("publicIP(nil) = true, want false")
+	}
+}
@@ -1,8 +1,13 @@
 CREATE TABLE boards (
   id text PRIMARY KEY,
-  token text NOT NULL,
+  token text NOT NULL, -- encrypted, see tokens.go
   email text NOT NULL,
   webhook_id text NOT NULL,
+  degraded boolean NOT NULL DEFAULT false, -- no valid tokens left
+  token_ok boolean NOT NULL DEFAULT true,
+  webhook_ok boolean NOT NULL DEFAULT true,
+  checked_at timestamptz NOT NULL DEFAULT now(),
+  settings jsonb NOT NULL DEFAULT '{}', -- see settings.go
 
   CHECK (id != ''),
   CHECK (token != ''),
@@ -10,14 +15,59 @@ CREATE TABLE boards (
   CHECK (webhook_id != '')
 );
 
+CREATE TABLE tokens (
+  board text REFERENCES boards (id) ON DELETE CASCADE,
+  member text NOT NULL,
+  email text NOT NULL,
+  token text NOT NULL, -- encrypted, see tokens.go
+  valid boolean NOT NULL DEFAULT true,
+
+  PRIMARY KEY (board, member),
+  CHECK (member != ''),
+  CHECK (token != '')
+);
+
 CREATE TABLE backups (
   id text PRIMARY KEY,
   board text REFERENCES boards (id) ON DELETE CASCADE,
   data jsonb NOT NULL,
+  deleted_at timestamptz, -- cards deleted by allowed users, kept to be restored
+  deleted_by text NOT NULL DEFAULT '',
 
   CHECK (id != ''),
   CHECK (board != '')
 );
+CREATE INDEX ON backups (board, deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE TABLE approvals (
+  id serial PRIMARY KEY,
+  board text REFERENCES boards (id) ON DELETE CASCADE,
+  webhook jsonb NOT NULL, -- the reverted action
+  status text NOT NULL DEFAULT 'pending', -- 'approved', 'denied'
+  created_at timestamptz NOT NULL DEFAULT now(),
+  decided_by text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE reverts (
+  id serial PRIMARY KEY,
+  board text REFERENCES boards (id) ON DELETE CASCADE,
+  webhook jsonb NOT NULL, -- the reverted action
+  error text NOT NULL DEFAULT '', -- when the reset failed
+  created_at timestamptz NOT NULL DEFAULT now(),
+  notified_at timestamptz
+);
+CREATE INDEX ON reverts (board, created_at);
 
-table boards;
-select id, board from backups order by board;
+CREATE TABLE api_keys (
+  id serial PRIMARY KEY,
+  member text NOT NULL,
+  username text NOT NULL,
+  email text NOT NULL,
+  token text NOT NULL, -- encrypted, see tokens.go
+  key_hash text UNIQUE NOT NULL, -- sha256 of the key, which is never stored
+  prefix text NOT NULL, -- so users can tell their keys apart
+  created_at timestamptz NOT NULL DEFAULT now(),
+  last_used_at timestamptz NOT NULL DEFAULT now(),
+
+  CHECK (member != '')
+);
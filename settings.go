@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BoardSettings are the permission rules of a board, stored as jsonb on
+// the boards table. empty values mean the default behavior.
+type BoardSettings struct {
+	// who can make each kind of change to a card (ALLOWADMINS or ALLOWMEMBERS).
+	// creating, commenting on and deleting cards count as edits.
+	Edit    string `json:"edit,omitempty"`
+	Archive string `json:"archive,omitempty"`
+	Due     string `json:"due,omitempty"`
+
+	// whether card members can remove themselves from cards: "always",
+	// "never" or empty to treat it as any other edit to the card
+	SelfRemoval string `json:"selfRemoval,omitempty"`
+
+	// what each type of board member ("normal", "observer" or "guest") can do,
+	// e.g. {"normal": {"anywhere": ["create"]}, "guest": {"only": ["comment"]}}
+	MemberTypes map[string]MemberTypePolicy `json:"memberTypes,omitempty"`
+
+	// windows of time during which only admins can change the board
+	Freezes []FreezeWindow `json:"freezes,omitempty"`
+
+	// instead of just reverting, let admins approve blocked changes later
+	Approvals bool `json:"approvals,omitempty"`
+
+	// comment on cards telling users why their changes were reverted
+	ExplainReverts bool `json:"explainReverts,omitempty"`
+
+	// email admins about reverted changes: "immediately", "hourly" or "daily"
+	Notify string `json:"notify,omitempty"`
+
+	// where to send events about each processed action, see outgoing.go
+	Webhooks []OutgoingWebhook `json:"webhooks,omitempty"`
+}
+
+type MemberTypePolicy struct {
+	// kinds of changes allowed on any card, even if they aren't members of it
+	Anywhere []string `json:"anywhere,omitempty"`
+
+	// when set, these are the only kinds of changes allowed, even on their cards
+	Only []string `json:"only,omitempty"`
+}
+
+// allows tells if all the given kinds are in the list.
+func allows(list []string, kinds []string) bool {
+	for _, kind := range kinds {
+		found := false
+		for _, allowed := range list {
+			if allowed == kind {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (bs BoardSettings) allowed(kind string) string {
+	var level string
+	switch kind {
+	case "edit", "create", "comment", "delete":
+		// these used to be edits, so they're still restricted along with them
+		level = bs.Edit
+	case "archive":
+		level = bs.Archive
+	case "due":
+		level = bs.Due
+	}
+
+	if level == "" {
+		return ALLOWMEMBERS
+	}
+	return level
+}
+
+// validate rejects settings with values we wouldn't know how to enforce.
+func (bs BoardSettings) validate() error {
+	for _, level := range []string{bs.Edit, bs.Archive, bs.Due} {
+		if level != "" && level != ALLOWADMINS && level != ALLOWMEMBERS {
+			return errors.New("invalid permission level: " + level)
+		}
+	}
+	switch bs.SelfRemoval {
+	case "", "always", "never":
+	default:
+		return errors.New("invalid selfRemoval: " + bs.SelfRemoval)
+	}
+	switch bs.Notify {
+	case "", "immediately", "hourly", "daily":
+	default:
+		return errors.New("invalid notify: " + bs.Notify)
+	}
+	for memberType, policy := range bs.MemberTypes {
+		switch memberType {
+		case "normal", "observer", "guest":
+		default:
+			return errors.New("invalid member type: " + memberType)
+		}
+		for _, list := range [][]string{policy.Anywhere, policy.Only} {
+			for _, kind := range list {
+				if !changeKinds[kind] {
+					return errors.New("invalid kind of change: " + kind)
+				}
+			}
+		}
+	}
+	for _, fw := range bs.Freezes {
+		if err := fw.validate(); err != nil {
+			return err
+		}
+	}
+	for _, target := range bs.Webhooks {
+		if err := validateOutgoingURL(target.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *BoardSettings) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, bs)
+	case string:
+		return json.Unmarshal([]byte(v), bs)
+	case nil:
+		return nil
+	}
+	return errors.New("can't scan board settings")
+}
+
+func (bs BoardSettings) Value() (driver.Value, error) {
+	return json.Marshal(bs)
+}
+
+// the kinds returned by cardChangeKinds
+var changeKinds = map[string]bool{
+	"edit":    true,
+	"archive": true,
+	"due":     true,
+	"create":  true,
+	"comment": true,
+	"delete":  true,
+}
+
+// cardChangeKinds tells which kinds of changes to a card an action makes,
+// so they can be checked against the board settings.
+func cardChangeKinds(wh Webhook) []string {
+	switch wh.Action.Type {
+	case "createCard", "copyCard", "convertToCardFromCheckItem":
+		return []string{"create"}
+	case "deleteCard":
+		return []string{"delete"}
+	case "commentCard":
+		return []string{"comment"}
+	case "updateCard":
+	default:
+		return []string{"edit"}
+	}
+
+	var kinds []string
+	for changedKey := range wh.Action.Data.Old {
+		switch changedKey {
+		case "closed":
+			kinds = append(kinds, "archive")
+		case "due", "dueComplete":
+			kinds = append(kinds, "due")
+		default:
+			kinds = append(kinds, "edit")
+		}
+	}
+	return kinds
+}
+
+// FreezeWindow is a cron-like window of time, e.g. weekends are
+// {"days": "sat,sun"}, out of hours {"days": "mon-fri", "start": "18:00",
+// "end": "09:00"} and a release freeze {"from": "2018-12-20", "until": "2019-01-02"}.
+type FreezeWindow struct {
+	Name     string `json:"name,omitempty"`
+	TimeZone string `json:"timezone,omitempty"` // like "America/Sao_Paulo", defaults to UTC
+
+	// day-of-week field as in cron: "*", "1-5", "sat,sun", "mon-wed,fri"
+	Days string `json:"days,omitempty"`
+
+	// times of the day, "15:04". when end is before start the window goes
+	// through midnight.
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+
+	// dates limiting the window, "2006-01-02" or "2006-01-02 15:04"
+	From  string `json:"from,omitempty"`
+	Until string `json:"until,omitempty"`
+}
+
+// frozen returns the name of the freeze window in which the given moment is.
+func (bs BoardSettings) frozen(t time.Time) (name string, ok bool) {
+	for i, fw := range bs.Freezes {
+		if fw.active(t) {
+			name = fw.Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i)
+			}
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// validate rejects windows that active() wouldn't be able to match, as they
+// would silently never freeze anything.
+func (fw FreezeWindow) validate() error {
+	loc, err := time.LoadLocation(fw.TimeZone)
+	if err != nil {
+		return errors.New("invalid freeze timezone: " + fw.TimeZone)
+	}
+
+	if fw.Days != "" && fw.Days != "*" {
+		for _, part := range strings.Split(fw.Days, ",") {
+			for _, bound := range strings.SplitN(part, "-", 2) {
+				if _, ok := cronDay(bound); !ok {
+					return errors.New("invalid freeze days: " + fw.Days)
+				}
+			}
+		}
+	}
+
+	if _, err := parseFreezeTime(fw.Start, 0); err != nil {
+		return errors.New("invalid freeze start: " + fw.Start)
+	}
+	if _, err := parseFreezeTime(fw.End, 0); err != nil {
+		return errors.New("invalid freeze end: " + fw.End)
+	}
+
+	if fw.From != "" {
+		if _, err := parseFreezeDate(fw.From, loc); err != nil {
+			return errors.New("invalid freeze from: " + fw.From)
+		}
+	}
+	if fw.Until != "" {
+		if _, err := parseFreezeDate(fw.Until, loc); err != nil {
+			return errors.New("invalid freeze until: " + fw.Until)
+		}
+	}
+	return nil
+}
+
+func (fw FreezeWindow) active(t time.Time) bool {
+	loc, err := time.LoadLocation(fw.TimeZone)
+	if err != nil {
+		log.Warn().Err(err).Str("timezone", fw.TimeZone).Msg("invalid freeze timezone")
+		loc = time.UTC
+	}
+	t = t.In(loc)
+
+	if fw.From != "" {
+		if from, err := parseFreezeDate(fw.From, loc); err != nil || t.Before(from) {
+			return false
+		}
+	}
+	if fw.Until != "" {
+		if until, err := parseFreezeDate(fw.Until, loc); err != nil || !t.Before(until) {
+			return false
+		}
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	start, err := parseFreezeTime(fw.Start, 0)
+	if err != nil {
+		return false
+	}
+	end, err := parseFreezeTime(fw.End, 24*60)
+	if err != nil {
+		return false
+	}
+
+	day := t.Weekday()
+	if end <= start {
+		// through midnight, so the early hours belong to the previous day
+		if minute < end {
+			day = (day + 6) % 7
+		} else if minute < start {
+			return false
+		}
+	} else if minute < start || minute >= end {
+		return false
+	}
+
+	return cronDayMatches(fw.Days, day)
+}
+
+func parseFreezeDate(value string, loc *time.Location) (time.Time, error) {
+	if len(value) == len("2006-01-02") {
+		return time.ParseInLocation("2006-01-02", value, loc)
+	}
+	return time.ParseInLocation("2006-01-02 15:04", value, loc)
+}
+
+func parseFreezeTime(value string, empty int) (minute int, err error) {
+	if value == "" {
+		return empty, nil
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+var cronDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func cronDayMatches(field string, day time.Weekday) bool {
+	if field == "" || field == "*" {
+		return true
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		from, ok := cronDay(bounds[0])
+		if !ok {
+			continue
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = cronDay(bounds[1]); !ok {
+				continue
+			}
+		}
+
+		if from <= to && day >= from && day <= to {
+			return true
+		}
+		if from > to && (day >= from || day <= to) {
+			return true
+		}
+	}
+	return false
+}
+
+func cronDay(value string) (time.Weekday, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for i, name := range cronDays {
+		if strings.HasPrefix(value, name) {
+			return time.Weekday(i), true
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > 7 {
+		return 0, false
+	}
+	return time.Weekday(n % 7), true
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCardChangeKinds(t *testing.T) {
+	for _, test := range []struct {
+		actionType string
+		old        map[string]interface{}
+		kinds      []string
+	}{
+		{"createCard", nil, []string{"create"}},
+		{"copyCard", nil, []string{"create"}},
+		{"convertToCardFromCheckItem", nil, []string{"create"}},
+		{"deleteCard", nil, []string{"delete"}},
+		{"commentCard", nil, []string{"comment"}},
+		{"addLabelToCard", nil, []string{"edit"}},
+		{"updateCard", map[string]interface{}{"closed": false}, []string{"archive"}},
+		{"updateCard", map[string]interface{}{"due": nil}, []string{"due"}},
+		{"updateCard", map[string]interface{}{"dueComplete": false}, []string{"due"}},
+		{"updateCard", map[string]interface{}{"name": "x"}, []string{"edit"}},
+		{"updateCard", map[string]interface{}{"closed": false, "desc": ""},
+			[]string{"archive", "edit"}},
+		{"updateCard", nil, nil},
+	} {
+		var wh Webhook
+		wh.Action.Type = test.actionType
+		wh.Action.Data.Old = test.old
+
+		kinds := cardChangeKinds(wh)
+		sort.Strings(kinds)
+		if !reflect.DeepEqual(kinds, test.kinds) {
+			t.Errorf("cardChangeKinds(%s %v) = %v, want %v",
+				test.actionType, test.old, kinds, test.kinds)
+		}
+	}
+}
+
+func TestCronDayMatches(t *testing.T) {
+	for _, test := range []struct {
+		field string
+		day   time.Weekday
+		match bool
+	}{
+		{"", time.Wednesday, true},
+		{"*", time.Sunday, true},
+		{"sat,sun", time.Saturday, true},
+		{"sat,sun", time.Sunday, true},
+		{"sat,sun", time.Monday, false},
+		{"1-5", time.Monday, true},
+		{"1-5", time.Friday, true},
+		{"1-5", time.Saturday, false},
+		{"mon-wed,fri", time.Tuesday, true},
+		{"mon-wed,fri", time.Thursday, false},
+		{"mon-wed,fri", time.Friday, true},
+		{"Monday-Friday", time.Thursday, true},
+		// ranges wrapping around the end of the week
+		{"fri-mon", time.Saturday, true},
+		{"fri-mon", time.Monday, true},
+		{"fri-mon", time.Wednesday, false},
+		// 7 is sunday too
+		{"7", time.Sunday, true},
+		{"5-7", time.Sunday, true},
+		{"xyz", time.Monday, false},
+	} {
+		if got := cronDayMatches(test.field, test.day); got != test.match {
+			t.Errorf("cronDayMatches(%q, %s) = %v, want %v",
+				test.field, test.day, got, test.match)
+		}
+	}
+}
+
+func TestFreezeWindowActive(t *testing.T) {
+	saoPaulo, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Skip("no timezone database:", err)
+	}
+
+	// 2018-12-21 is a friday
+	at := func(value string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", value, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	outOfHours := FreezeWindow{Days: "mon-fri", Start: "18:00", End: "09:00"}
+	weekends := FreezeWindow{Days: "sat,sun"}
+	release := FreezeWindow{From: "2018-12-20", Until: "2019-01-02"}
+
+	for _, test := range []struct {
+		name   string
+		window FreezeWindow
+		t      time.Time
+		active bool
+	}{
+		{"weekend saturday", weekends, at("2018-12-22 10:00"), true},
+		{"weekend sunday night", weekends, at("2018-12-23 23:59"), true},
+		{"weekend friday", weekends, at("2018-12-21 23:59"), false},
+
+		{"friday evening", outOfHours, at("2018-12-21 18:00"), true},
+		{"friday afternoon", outOfHours, at("2018-12-21 17:59"), false},
+		{"friday working hours", outOfHours, at("2018-12-21 09:00"), false},
+		// the early hours belong to the day the window started
+		{"tuesday early hours", outOfHours, at("2018-12-25 08:59"), true},
+		{"saturday early hours", outOfHours, at("2018-12-22 03:00"), true},
+		{"monday early hours", outOfHours, at("2018-12-24 03:00"), false},
+		{"saturday evening", outOfHours, at("2018-12-22 20:00"), false},
+
+		{"daytime window", FreezeWindow{Start: "12:00", End: "13:00"}, at("2018-12-21 12:30"), true},
+		{"daytime window end", FreezeWindow{Start: "12:00", End: "13:00"}, at("2018-12-21 13:00"), false},
+
+		{"release start", release, at("2018-12-20 00:00"), true},
+		{"release middle", release, at("2018-12-25 12:00"), true},
+		{"release before", release, at("2018-12-19 23:59"), false},
+		{"release until is exclusive", release, at("2019-01-02 00:00"), false},
+		{"from with time", FreezeWindow{From: "2018-12-21 15:00"}, at("2018-12-21 14:59"), false},
+		{"from with time after", FreezeWindow{From: "2018-12-21 15:00"}, at("2018-12-21 15:00"), true},
+		{"release on weekdays", FreezeWindow{Days: "mon-fri", From: "2018-12-20", Until: "2019-01-02"},
+			at("2018-12-22 12:00"), false},
+
+		// 20:30 UTC is 18:30 in São Paulo (UTC-2 in december 2018)
+		{"timezone evening", FreezeWindow{TimeZone: "America/Sao_Paulo", Start: "18:00", End: "09:00"},
+			at("2018-12-21 20:30"), true},
+		{"timezone afternoon", FreezeWindow{TimeZone: "America/Sao_Paulo", Start: "18:00", End: "09:00"},
+			at("2018-12-21 19:30"), false},
+		// 01:00 UTC on saturday is still friday in São Paulo
+		{"timezone changes the day", FreezeWindow{TimeZone: "America/Sao_Paulo", Days: "fri"},
+			at("2018-12-22 01:00"), true},
+		{"timezone dates", FreezeWindow{TimeZone: "America/Sao_Paulo", Until: "2018-12-22"},
+			at("2018-12-22 01:00"), true},
+		{"timezone dates after", FreezeWindow{TimeZone: "America/Sao_Paulo", Until: "2018-12-22"},
+			time.Date(2018, 12, 22, 0, 0, 0, 0, saoPaulo), false},
+
+		{"bad start", FreezeWindow{Start: "6pm"}, at("2018-12-21 20:00"), false},
+	} {
+		if got := test.window.active(test.t); got != test.active {
+			t.Errorf("%s: active(%s) = %v, want %v",
+				test.name, test.t.Format(time.RFC3339), got, test.active)
+		}
+	}
+}
+
+func TestFreezeWindowValidate(t *testing.T) {
+	for _, test := range []struct {
+		window FreezeWindow
+		valid  bool
+	}{
+		{FreezeWindow{}, true},
+		{FreezeWindow{Days: "mon-fri", Start: "18:00", End: "09:00"}, true},
+		{FreezeWindow{Days: "*", From: "2018-12-20", Until: "2019-01-02 12:00"}, true},
+		{FreezeWindow{Days: "mon-fry"}, false},
+		{FreezeWindow{Days: "sat,"}, false},
+		{FreezeWindow{Start: "6pm"}, false},
+		{FreezeWindow{End: "25:00"}, false},
+		{FreezeWindow{From: "20/12/2018"}, false},
+		{FreezeWindow{Until: "2019-01-02T00:00"}, false},
+		{FreezeWindow{TimeZone: "Mars/Olympus"}, false},
+	} {
+		if err := test.window.validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: validate() = %v, want valid %v", test.window, err, test.valid)
+		}
+	}
+}
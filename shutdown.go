@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// resets in progress and what they do in the background (explanations,
+// outgoing webhooks, emails), so it can all finish before we exit.
+// it's a counter under a mutex instead of a WaitGroup because things keep
+// being started while we wait.
+var inflight = struct {
+	sync.Mutex
+	idle     *sync.Cond
+	count    int
+	draining bool // set when we've got a SIGTERM and aren't accepting webhooks anymore
+}{}
+
+func init() {
+	inflight.idle = sync.NewCond(&inflight.Mutex)
+}
+
+func isDraining() bool {
+	inflight.Lock()
+	defer inflight.Unlock()
+	return inflight.draining
+}
+
+// startReset counts a reset that is about to start, unless we're shutting
+// down, in which case it returns false and the reset must not happen.
+// finishWork must be called when it is done.
+func startReset() bool {
+	inflight.Lock()
+	defer inflight.Unlock()
+	if inflight.draining {
+		return false
+	}
+	inflight.count++
+	return true
+}
+
+// startWork counts something that must finish before we exit. unlike
+// resets, these are accepted while draining, as they're started by the
+// resets we're waiting for. finishWork must be called when it is done.
+func startWork() {
+	inflight.Lock()
+	inflight.count++
+	inflight.Unlock()
+}
+
+func finishWork() {
+	inflight.Lock()
+	inflight.count--
+	if inflight.count == 0 {
+		inflight.idle.Broadcast()
+	}
+	inflight.Unlock()
+}
+
+// goBackground runs f in a goroutine we wait for before exiting.
+func goBackground(f func()) {
+	startWork()
+	go func() {
+		defer finishWork()
+		f()
+	}()
+}
+
+// drainResets stops accepting webhooks and waits for the resets in progress
+// (and everything they started) to finish. returns false if they didn't
+// finish before the timeout.
+func drainResets(timeout time.Duration) bool {
+	inflight.Lock()
+	inflight.draining = true
+	inflight.Unlock()
+
+	// don't wait for the explanations to be grouped
+	flushExplanations()
+
+	done := make(chan struct{})
+	go func() {
+		inflight.Lock()
+		for inflight.count > 0 {
+			inflight.idle.Wait()
+		}
+		inflight.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// checkDependencies returns the error of each service we depend on that
+// isn't working.
+func checkDependencies() map[string]string {
+	failures := make(map[string]string)
+
+	if err := pg.Ping(); err != nil {
+		failures["postgres"] = err.Error()
+	}
+
+	if s.RedisURL != "" {
+		if err := rds.Ping().Err(); err != nil {
+			failures["redis"] = err.Error()
+		}
+	}
+
+	if ok, err := ms3.BucketExists(s.S3BucketName); err != nil {
+		failures["s3"] = err.Error()
+	} else if !ok {
+		failures["s3"] = "bucket " + s.S3BucketName + " doesn't exist"
+	}
+
+	return failures
+}
+
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	failures := checkDependencies()
+	if len(failures) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(503)
+		json.NewEncoder(w).Encode(failures)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// serveReadyz is like serveHealthz, but also fails when we're shutting down
+// so no more webhooks are routed here.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if isDraining() {
+		http.Error(w, "shutting down", 503)
+		return
+	}
+	serveHealthz(w, r)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Trello tokens are stored as "<keyid>:<base64(nonce|ciphertext)>", encrypted
+// with AES-GCM. Keys are read from TOKEN_KEY_FILE (one "<keyid> <secret>" per
+// line, the last one being the current key) or, if that isn't set, derived
+// from SECRET_KEY under the key id "0".
+// The SECRET_KEY key is always loaded, so tokens sealed before TOKEN_KEY_FILE
+// was set can still be opened (unless the file defines its own key "0").
+// Values without a key id are legacy plaintext tokens.
+
+var tokenKeys = make(map[string]cipher.AEAD)
+var currentTokenKeyId string
+
+func loadTokenKeys() error {
+	err := addTokenKey("0", "permissionsfortrello/tokens:"+s.SecretKey)
+	if err != nil || s.TokenKeyFile == "" {
+		return err
+	}
+
+	// only keys from the file can be the current one from now on
+	currentTokenKeyId = ""
+
+	f, err := os.Open(s.TokenKeyFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) != 2 || strings.Contains(parts[0], ":") {
+			return fmt.Errorf("invalid line on token key file: '%s'", line)
+		}
+
+		err = addTokenKey(parts[0], parts[1])
+		if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if currentTokenKeyId == "" {
+		return errors.New("no keys found on token key file")
+	}
+	return nil
+}
+
+func addTokenKey(id, secret string) error {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	tokenKeys[id] = aead
+	currentTokenKeyId = id
+	return nil
+}
+
+func sealToken(token string) (string, error) {
+	aead := tokenKeys[currentTokenKeyId]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(currentTokenKeyId))
+	return currentTokenKeyId + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func openToken(stored string) (string, error) {
+	keyId, ok := tokenKeyId(stored)
+	if !ok {
+		// legacy plaintext token
+		return stored, nil
+	}
+
+	aead, ok := tokenKeys[keyId]
+	if !ok {
+		return "", fmt.Errorf("unknown token key '%s'", keyId)
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(stored[len(keyId)+1:])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("sealed token is too short")
+	}
+
+	nonce := sealed[:aead.NonceSize()]
+	token, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(keyId))
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+func tokenKeyId(stored string) (keyId string, ok bool) {
+	i := strings.Index(stored, ":")
+	if i == -1 {
+		return "", false
+	}
+	return stored[:i], true
+}
+
+// rotateTokens re-encrypts every stored token that isn't sealed with the
+// current key (including legacy plaintext ones), all in one transaction.
+func rotateTokens() (rotated int, err error) {
+	tx, err := pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			rotated = 0
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	// tokens attached to boards, also replacing the board's current token
+	// when it is the same
+	var attached []struct {
+		Board  string `db:"board"`
+		Member string `db:"member"`
+		Token  string `db:"token"`
+	}
+	err = tx.Select(&attached, `SELECT board, member, token FROM tokens`)
+	if err != nil {
+		return
+	}
+
+	for _, row := range attached {
+		sealed, ok := resealToken(row.Token)
+		if !ok {
+			continue
+		}
+
+		_, err = tx.Exec(`
+WITH
+tk AS (
+  UPDATE tokens SET token = $4
+  WHERE board = $1 AND member = $2 AND token = $3
+)
+UPDATE boards SET token = $4
+WHERE id = $1 AND token = $3
+        `, row.Board, row.Member, row.Token, sealed)
+		if err != nil {
+			return
+		}
+		rotated++
+	}
+
+	// boards whose current token isn't attached (enabled before tokens existed)
+	var boards []struct {
+		Id    string `db:"id"`
+		Token string `db:"token"`
+	}
+	err = tx.Select(&boards, `SELECT id, token FROM boards`)
+	if err != nil {
+		return
+	}
+
+	for _, row := range boards {
+		sealed, ok := resealToken(row.Token)
+		if !ok {
+			continue
+		}
+
+		_, err = tx.Exec(`
+UPDATE boards SET token = $3
+WHERE id = $1 AND token = $2
+        `, row.Id, row.Token, sealed)
+		if err != nil {
+			return
+		}
+		rotated++
+	}
+
+	// tokens behind api keys
+	var apikeys []struct {
+		Id    int    `db:"id"`
+		Token string `db:"token"`
+	}
+	err = tx.Select(&apikeys, `SELECT id, token FROM api_keys`)
+	if err != nil {
+		return
+	}
+
+	for _, row := range apikeys {
+		sealed, ok := resealToken(row.Token)
+		if !ok {
+			continue
+		}
+
+		_, err = tx.Exec(`
+UPDATE api_keys SET token = $3
+WHERE id = $1 AND token = $2
+        `, row.Id, row.Token, sealed)
+		if err != nil {
+			return
+		}
+		rotated++
+	}
+
+	return
+}
+
+func resealToken(stored string) (sealed string, ok bool) {
+	if keyId, ok := tokenKeyId(stored); ok && keyId == currentTokenKeyId {
+		return "", false
+	}
+
+	token, err := openToken(stored)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to decrypt token")
+		return "", false
+	}
+
+	sealed, err = sealToken(token)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to encrypt token")
+		return "", false
+	}
+	return sealed, true
+}
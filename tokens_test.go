@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// useTokenKeys replaces the token keys with the given ones (the last being
+// the current) for the duration of the test.
+func useTokenKeys(t *testing.T, ids ...string) {
+	previousKeys, previousId := tokenKeys, currentTokenKeyId
+	t.Cleanup(func() {
+		tokenKeys, currentTokenKeyId = previousKeys, previousId
+	})
+
+	tokenKeys = make(map[string]cipher.AEAD)
+	for _, id := range ids {
+		if err := addTokenKey(id, "secret "+id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testDatabase loads postgres.sql into a new schema on the database at
+// TEST_DATABASE_URL, skipping the test when that isn't set.
+func testDatabase(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := sqlx.Connect("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a single connection, so they all see the schema below
+	db.SetMaxOpenConns(1)
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	ddl, err := ioutil.ReadFile("postgres.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE SCHEMA ` + schema + `; SET search_path TO ` + schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(string(ddl))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := pg
+	pg = db
+	t.Cleanup(func() {
+		db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		db.Close()
+		pg = previous
+	})
+}
+
+func TestSealToken(t *testing.T) {
+	useTokenKeys(t, "1", "2")
+
+	for _, token := range []string{"", "a-trello-token", strings.Repeat("x", 1000)} {
+		sealed, err := sealToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(sealed, "2:") {
+			t.Errorf("%q isn't sealed with the current key", sealed)
+		}
+		if token != "" && strings.Contains(sealed, token) {
+			t.Errorf("%q contains the plaintext token", sealed)
+		}
+		if opened, err := openToken(sealed); err != nil || opened != token {
+			t.Errorf("openToken(%q) = %q, %v; want %q", sealed, opened, err, token)
+		}
+	}
+
+	// the same token sealed twice gets different nonces
+	a, _ := sealToken("token")
+	b, _ := sealToken("token")
+	if a == b {
+		t.Errorf("sealed the same token twice as %q", a)
+	}
+}
+
+func TestOpenToken(t *testing.T) {
+	useTokenKeys(t, "1")
+	sealedOld, err := sealToken("old-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTokenKeys(t, "1", "2")
+	sealed, err := sealToken("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := sealed[len("2:"):]
+
+	// flips the last character of the payload
+	tampered := payload[:len(payload)-1] + "A"
+	if strings.HasSuffix(payload, "A") {
+		tampered = payload[:len(payload)-1] + "B"
+	}
+
+	for _, test := range []struct {
+		name   string
+		stored string
+		token  string
+		valid  bool
+	}{
+		{"current key", sealed, "token", true},
+		{"previous key", sealedOld, "old-token", true},
+		{"legacy plaintext", "a-plaintext-token", "a-plaintext-token", true},
+		{"unknown key", "3:" + payload, "", false},
+		// the key id is authenticated, so it can't be swapped
+		{"wrong key", "1:" + payload, "", false},
+		{"tampered", "2:" + tampered, "", false},
+		{"not base64", "2:!!!", "", false},
+		{"too short", "2:AAAA", "", false},
+	} {
+		token, err := openToken(test.stored)
+		if (err == nil) != test.valid || token != test.token {
+			t.Errorf("%s: openToken(%q) = %q, %v; want %q, valid %v",
+				test.name, test.stored, token, err, test.token, test.valid)
+		}
+	}
+}
+
+func TestLoadTokenKeys(t *testing.T) {
+	previousSettings := s
+	t.Cleanup(func() { s = previousSettings })
+	useTokenKeys(t)
+
+	s.SecretKey = "secret"
+	s.TokenKeyFile = ""
+	if err := loadTokenKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if currentTokenKeyId != "0" {
+		t.Errorf("current key is %q without a key file, want \"0\"", currentTokenKeyId)
+	}
+	sealedWithSecret, _ := sealToken("token")
+
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name    string
+		file    string
+		current string
+		valid   bool
+	}{
+		{"keys", "# comment\n\n1 first\n2 second\n", "2", true},
+		{"no keys", "# nothing here\n", "", false},
+		{"bad line", "1 first extra\n", "", false},
+		{"colon on id", "a:b secret\n", "", false},
+	} {
+		useTokenKeys(t)
+		s.TokenKeyFile = dir + "/" + strings.ReplaceAll(test.name, " ", "-")
+		if err := ioutil.WriteFile(s.TokenKeyFile, []byte(test.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		err := loadTokenKeys()
+		if (err == nil) != test.valid {
+			t.Errorf("%s: loadTokenKeys() = %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if currentTokenKeyId != test.current {
+			t.Errorf("%s: current key is %q, want %q", test.name, currentTokenKeyId, test.current)
+		}
+		// tokens sealed with SECRET_KEY can still be opened
+		if token, err := openToken(sealedWithSecret); err != nil || token != "token" {
+			t.Errorf("%s: openToken(%q) = %q, %v", test.name, sealedWithSecret, token, err)
+		}
+	}
+}
+
+func TestRotateTokens(t *testing.T) {
+	testDatabase(t)
+	useTokenKeys(t, "old")
+
+	sealed := make(map[string]string)
+	for _, token := range []string{"board-token", "member-token", "apikey-token"} {
+		var err error
+		sealed[token], err = sealToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := pg.Exec(`
+INSERT INTO boards (id, token, email, webhook_id) VALUES ('b1', $1, 'a@b.c', 'w1');
+    `, sealed["board-token"])
+	if err == nil {
+		_, err = pg.Exec(`
+INSERT INTO tokens (board, member, email, token) VALUES ('b1', 'm1', 'a@b.c', $1)
+        `, sealed["member-token"])
+	}
+	if err == nil {
+		_, err = pg.Exec(`
+INSERT INTO api_keys (member, username, email, token, key_hash, prefix)
+VALUES ('m1', 'someone', 'a@b.c', $1, 'hash', 'pft_')
+        `, sealed["apikey-token"])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new key comes in, the old one is still there to open what it sealed
+	if err := addTokenKey("new", "secret new"); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := rotateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 3 {
+		t.Errorf("rotated %d tokens, want 3", rotated)
+	}
+
+	// the old key may now be dropped
+	delete(tokenKeys, "old")
+
+	for _, test := range []struct {
+		query string
+		token string
+	}{
+		{`SELECT token FROM boards WHERE id = 'b1'`, "board-token"},
+		{`SELECT token FROM tokens WHERE member = 'm1'`, "member-token"},
+		{`SELECT token FROM api_keys WHERE member = 'm1'`, "apikey-token"},
+	} {
+		var stored string
+		if err := pg.Get(&stored, test.query); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(stored, "new:") {
+			t.Errorf("%s: %q isn't sealed with the new key", test.query, stored)
+		}
+		if token, err := openToken(stored); err != nil || token != test.token {
+			t.Errorf("%s: opened %q, %v; want %q", test.query, token, err, test.token)
+		}
+	}
+
+	// nothing left to rotate
+	rotated, err = rotateTokens()
+	if err != nil || rotated != 0 {
+		t.Errorf("second rotation: rotated %d, %v; want 0", rotated, err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spans started before startTracing are dropped
+var tracer = otel.Tracer("permissionsfortrello")
+
+// startTracing exports spans to the OTLP collector at OTLP_ENDPOINT or, if
+// that isn't set, prints them to stdout. the returned function flushes them.
+func startTracing() (shutdown func(context.Context) error, err error) {
+	var exporter sdktrace.SpanExporter
+	if s.OTLPEndpoint != "" {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(s.OTLPEndpoint)}
+		if s.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	} else {
+		exporter, err = stdouttrace.New()
+	}
+	if err != nil {
+		return
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "permissionsfortrello"),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// backupSpan traces a query to the backups table.
+func backupSpan(ctx context.Context, operation, id string) trace.Span {
+	_, span := tracer.Start(ctx, "backups "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("backup.id", id),
+		))
+	return span
+}
+
+// s3Span traces an operation on an attachment stored on S3.
+func s3Span(ctx context.Context, operation, id string) trace.Span {
+	_, span := tracer.Start(ctx, "s3 "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("s3.bucket", s.S3BucketName),
+			attribute.String("s3.key", id),
+		))
+	return span
+}
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"time"
+)
+
 type User struct {
 	Id         string `json:"id,omitempty"`
 	Username   string `json:"username,omitempty"`
@@ -9,23 +13,34 @@ type User struct {
 }
 
 type Board struct {
-	Id          string       `db:"id" json:"id,omitempty"`
-	ShortLink   string       `json:"shortLink,omitempty"`
-	Name        string       `json:"name,omitempty"`
-	Memberships []Membership `json:"memberships,omitempty"`
-	Prefs       struct {
+	Id             string       `db:"id" json:"id,omitempty"`
+	ShortLink      string       `json:"shortLink,omitempty"`
+	Name           string       `json:"name,omitempty"`
+	IdOrganization string       `json:"idOrganization,omitempty"`
+	Memberships    []Membership `json:"memberships,omitempty"`
+	Prefs          struct {
 		Invitations     string `json:"invitations,omitempty"`     // "admins"
 		PermissionLevel string `json:"permissionLevel,omitempty"` // "public"
 		Comments        string `json:"comments,omitempty" `       // "public"
+		Voting          string `json:"voting,omitempty"`          // "disabled"
+		Background      string `json:"background,omitempty"`      // "blue"
 	} `json:"prefs,omitempty"`
+	Closed  bool     `json:"closed,omitempty"`
 	Labels  []Label  `json:"labels,omitempty"`
 	Cards   []Card   `json:"cards,omitempty"`
 	Actions []Action `json:"actions,omitempty"`
 
-	Enabled   bool   `json:"-"`
-	Email     string `db:"email" json:"email"`
-	WebhookId string `db:"webhook_id" json:"-"`
-	Token     string `db:"token" json:"-"`
+	Enabled   bool      `json:"-"`
+	Attached  bool      `json:"-"`
+	Email     string    `db:"email" json:"email"`
+	WebhookId string    `db:"webhook_id" json:"-"`
+	Token     string    `db:"token" json:"-"`
+	Degraded  bool      `db:"degraded" json:"-"`
+	TokenOk   bool      `db:"token_ok" json:"-"`
+	WebhookOk bool      `db:"webhook_ok" json:"-"`
+	CheckedAt time.Time `db:"checked_at" json:"-"`
+
+	Settings BoardSettings `db:"settings" json:"-"`
 }
 
 type List struct {
@@ -57,6 +72,7 @@ type Card struct {
 	IdLabels          []string          `json:"idLabels,omitempty"`
 	Attachments       []Attachment      `json:"attachments,omitempty"`
 	CustomFieldItems  []CustomFieldItem `json:"customFieldItems,omitempty"`
+	IdMemberCreator   string            `json:"idMemberCreator,omitempty"`
 
 	IdChecklists  []string  `json:"idChecklists,omitempty"`
 	IdAttachments []string  `json:"idAttachments,omitempty"`
@@ -116,6 +132,7 @@ type Action struct {
 	Id            string `json:"id,omitempty"`
 	Data          Data   `json:data`
 	MemberCreator User   `json:"memberCreator,omitempty"`
+	Member        User   `json:"member,omitempty"`
 }
 
 type Data struct {
@@ -136,6 +153,8 @@ type Data struct {
 	CustomFieldItem CustomFieldItem        `json:"customFieldItem,omitempty"`
 	CustomField     CustomField            `json:"customField,omitempty"`
 	IdMember        string                 `json:"idMember,omitempty"`
+	IdMemberAdded   string                 `json:"idMemberAdded,omitempty"`
+	MemberType      string                 `json:"memberType,omitempty"` // on addMemberToBoard
 }
 
 type CustomField struct {
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
-	"github.com/kr/pretty"
-	"github.com/lib/pq"
 	"github.com/rs/zerolog"
 )
 
-func onUnallowed(logger zerolog.Logger, token string, wh Webhook) {
-	trello := makeTrelloClient(token)
+// errUnhandledAction is returned by onUnallowed for actions it doesn't know
+// how to revert, so nothing was done.
+var errUnhandledAction = errors.New("we don't know how to revert this action")
+
+func onUnallowed(ctx context.Context, logger zerolog.Logger, token string, wh Webhook) error {
+	plaintoken, err := openToken(token)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to decrypt board token")
+		return err
+	}
+	trello := makeLoggedTrelloClient(ctx, logger, plaintoken)
 	b := wh.Action.Data.Board.Id
 
 	switch wh.Action.Type {
@@ -29,7 +38,7 @@ func onUnallowed(logger zerolog.Logger, token string, wh Webhook) {
 			// attempt to fetch the checkItem data
 			// so we can restore its position and state
 			var checkItemId string
-			checkItemId, err = itemJustConvertedIntoCard(
+			checkItemId, err = itemJustConvertedIntoCard(ctx,
 				wh.Action.Data.Card.Name,
 				wh.Action.Data.Checklist.Id,
 			)
@@ -37,7 +46,7 @@ func onUnallowed(logger zerolog.Logger, token string, wh Webhook) {
 				break
 			}
 			var checkItemData CheckItem
-			err = fetchBackupData(checkItemId, &checkItemData)
+			err = fetchBackupData(ctx, checkItemId, &checkItemData)
 			if err != nil {
 				break
 			}
@@ -54,7 +63,7 @@ func onUnallowed(logger zerolog.Logger, token string, wh Webhook) {
 
 		// attempt to restore data from our backup
 		var backedCard Card
-		err = fetchBackupData(wh.Action.Data.Card.Id, &backedCard)
+		err = fetchBackupData(ctx, wh.Action.Data.Card.Id, &backedCard)
 		if err == nil {
 			wh.Action.Data.Card.Pos = backedCard.Pos
 			wh.Action.Data.Card.IdLabels = backedCard.IdLabels
@@ -66,7 +75,7 @@ func onUnallowed(logger zerolog.Logger, token string, wh Webhook) {
 			// we don't have access to the board to which this card was moved, so
 			// we must recreate the card.
 			wh.Action.Type = "deleteCard"
-			onUnallowed(logger, token, wh)
+			onUnallowed(ctx, logger, token, wh)
 			err = nil
 		}
 	case "moveCardToBoard":
@@ -110,13 +119,13 @@ SELECT * FROM comments
 
 		// fetch card attributes
 		var card Card
-		err = fetchBackupData(wh.Action.Data.Card.Id, &card)
+		err = fetchBackupData(ctx, wh.Action.Data.Card.Id, &card)
 		if err != nil {
 			card.Name = "--a card that was deleted by " +
 				wh.Action.MemberCreator.Username + "--"
 		} else {
 			card.Id = ""
-			go deleteBackupData(b, wh.Action.Data.Card.Id)
+			go deleteBackupData(ctx, b, wh.Action.Data.Card.Id)
 		}
 
 		card.IdList = wh.Action.Data.List.Id
@@ -138,7 +147,7 @@ SELECT * FROM comments
 			wh.Action.Type = "removeChecklistFromCard"
 			wh.Action.Data.Checklist.Id = idChecklist
 			wh.Action.Data.Card.Id = card.Id
-			onUnallowed(logger, token, wh)
+			onUnallowed(ctx, logger, token, wh)
 		}
 
 		// attempt to restore attachments
@@ -146,7 +155,7 @@ SELECT * FROM comments
 			wh.Action.Type = "deleteAttachmentFromCard"
 			wh.Action.Data.Attachment.Id = idAttachment
 			wh.Action.Data.Card.Id = card.Id
-			onUnallowed(logger, token, wh)
+			onUnallowed(ctx, logger, token, wh)
 		}
 
 		// attempt to restore comments
@@ -203,19 +212,28 @@ _On %s [%s](https://trello.com/%s) wrote:_
 			}
 		}
 
+		if _, archived := wh.Action.Data.Old["closed"]; archived {
+			// put it back where it was
+			var backedCard Card
+			err = fetchBackupData(ctx, wh.Action.Data.Card.Id, &backedCard)
+			if err == nil && backedCard.Pos != 0 {
+				data["pos"] = backedCard.Pos
+			}
+		}
+
 		err = trello("put", "/1/cards/"+wh.Action.Data.Card.Id, data, nil)
 	case "addMemberToCard":
+		invalidateCardMembers(wh.Action.Data.Card.Id)
 		err = trello("delete",
 			"/1/cards/"+wh.Action.Data.Card.Id+"/idMembers/"+wh.Action.Data.IdMember, nil, nil)
 	case "removeMemberFromCard":
+		invalidateCardMembers(wh.Action.Data.Card.Id)
 		err = trello("post", "/1/cards/"+wh.Action.Data.Card.Id+"/idMembers", struct {
 			Value string `json:"value"`
 		}{wh.Action.Data.IdMember}, nil)
 
-		// a member cannot remove itself because at the time we do this reset he is
-		// no longer a member of the card, so it is now allowed to perform the action.
-		// this can be bypassed by controlling for this special case, but do we really
-		// want it?
+		// whether members can remove themselves is decided by the board's
+		// SelfRemoval setting, see userAllowed.
 	case "addChecklistToCard":
 		err = trello("delete",
 			"/1/cards/"+wh.Action.Data.Card.Id+"/checklists/"+wh.Action.Data.Checklist.Id,
@@ -247,7 +265,7 @@ WHERE to_jsonb(ci.id) IN (
 		}
 
 		// remove all references to checklist and checkItems below from database
-		onAllowed(logger, token, wh)
+		onAllowed(ctx, logger, token, wh)
 
 		// now proceed to recreate
 		var newlist Checklist
@@ -307,15 +325,15 @@ WHERE to_jsonb(ci.id) IN (
 			nil, nil)
 	case "deleteAttachmentFromCard":
 		var att Attachment
-		err = fetchBackupData(wh.Action.Data.Attachment.Id, &att)
-		go deleteBackupData(b, wh.Action.Data.Attachment.Id)
+		err = fetchBackupData(ctx, wh.Action.Data.Attachment.Id, &att)
+		go deleteBackupData(ctx, b, wh.Action.Data.Attachment.Id)
 		if err != nil {
 			break
 		}
 
 		// remove the id of this deleted attachment from the idAttachments list
 		// in the backed up card
-		go updateBackupData(b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
+		go updateBackupData(ctx, b, wh.Action.Data.Card.Id, wh.Action.Data.Card,
 			`'{"idAttachments": []}'::jsonb || $init || data`,
 			`jsonb_set(data, '{idAttachments}', (data->'idAttachments') - ($arg::jsonb#>>'{}'))`,
 			wh.Action.Data.Attachment.Id,
@@ -325,14 +343,14 @@ WHERE to_jsonb(ci.id) IN (
 		// the onAllowed action will be triggered and the new attachment
 		// will be saved and backups will be updated
 		if attachmentIsUploaded(att) {
-			err = restoreFromS3(att.Id, att.Name, wh.Action.Data.Card.Id, token)
+			err = restoreFromS3(ctx, att.Id, att.Name, wh.Action.Data.Card.Id, plaintoken)
 		} else {
 			att.Id = ""
 			err = trello("post", "/1/cards/"+wh.Action.Data.Card.Id+
 				"/attachments", att, nil)
 		}
 
-		go deleteFromS3(wh.Action.Data.Attachment.Id)
+		go deleteFromS3(ctx, wh.Action.Data.Attachment.Id)
 	case "addLabelToCard":
 		err = trello("delete",
 			"/1/cards/"+wh.Action.Data.Card.Id+
@@ -347,12 +365,12 @@ WHERE to_jsonb(ci.id) IN (
 		err = trello("delete", "/1/labels/"+wh.Action.Data.Label.Id, nil, nil)
 	case "deleteLabel":
 		var label Label
-		err = fetchBackupData(wh.Action.Data.Label.Id, &label)
+		err = fetchBackupData(ctx, wh.Action.Data.Label.Id, &label)
 		if err != nil {
 			break
 		}
 
-		go deleteBackupData(b, wh.Action.Data.Label.Id)
+		go deleteBackupData(ctx, b, wh.Action.Data.Label.Id)
 
 		label.IdBoard = wh.Action.Data.Board.Id
 		label.Id = ""
@@ -365,11 +383,12 @@ WHERE to_jsonb(ci.id) IN (
 		}
 		// (the backup will be saved automatically by unAllowed)
 
-		// fetch ids of all cards that had this label
+		// fetch ids of all cards that had this label (and weren't deleted)
 		var cardIds []string
 		err = pg.Select(&cardIds, `
 SELECT id FROM backups
 WHERE data @> jsonb_build_object('idLabels', jsonb_build_array($1::text))
+  AND deleted_at IS NULL
         `, wh.Action.Data.Label.Id)
 		if err != nil {
 			break
@@ -416,19 +435,69 @@ WHERE data @> jsonb_build_object('idLabels', jsonb_build_array($1::text))
 		err = trello("put", "/1/lists/"+wh.Action.Data.List.Id, struct {
 			IdBoard string `json:"idBoard"`
 		}{wh.Action.Data.BoardSource.Id}, nil)
-	case "updateCustomFieldItem":
+	case "updateBoard":
+		var backedBoard Board
+		fetchBackupData(ctx, b, &backedBoard)
+
+		data := make(map[string]interface{})
+		for changedKey, changedValue := range wh.Action.Data.Old {
+			switch changedKey {
+			case "prefs":
+				// prefs must be reverted one by one
+				if prefs, ok := changedValue.(map[string]interface{}); ok {
+					for pref, value := range prefs {
+						data["prefs/"+pref] = value
+					}
+				}
+			case "name":
+				data["name"] = changedValue
+				if backedBoard.Name != "" {
+					data["name"] = backedBoard.Name
+				}
+			default:
+				data[changedKey] = changedValue
+			}
+		}
+
+		// reopen the board if it was closed
+		if wh.Action.Data.Board.Closed {
+			data["closed"] = false
+		}
+
+		err = trello("put", "/1/boards/"+b, data, nil)
+	case "addMemberToBoard":
+		invalidateBoardMemberships(b)
+		err = trello("delete", "/1/boards/"+b+"/members/"+targetMember(wh), nil, nil)
+	case "removeMemberFromBoard", "makeAdminOfBoard",
+		"makeNormalMemberOfBoard", "makeObserverOfBoard":
+		invalidateBoardMemberships(b)
+
+		// restore the member with the type it had before
+		idMember := targetMember(wh)
+		memberType := "normal"
+		var backedBoard Board
+		err = fetchBackupData(ctx, b, &backedBoard)
+		if err == nil {
+			for _, m := range backedBoard.Memberships {
+				if m.IdMember == idMember {
+					memberType = m.MemberType
+				}
+			}
+		}
+
+		err = trello("put", "/1/boards/"+b+"/members/"+idMember, struct {
+			Type string `json:"type"`
+		}{memberType}, nil)
 	default:
+		// e.g. updateCustomFieldItem
 		logger.Debug().Msg("unhandled webhook")
-		return
+		return errUnhandledAction
 	}
 
 	if err != nil {
-		if perr, ok := err.(*pq.Error); ok {
-			pretty.Log(perr)
-		}
-
-		logger.Warn().
-			Err(err).
+		withPqFields(logger.Warn().Err(err), err).
 			Msg("failed to reset action")
 	}
+
+	return err
 }
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if !startReset() {
+		// trello will retry it later, hopefully on another instance
+		w.WriteHeader(503)
+		return
+	}
 	w.WriteHeader(200)
 
+	// not the request context: the reset goes on after we respond
+	ctx, span := tracer.Start(context.Background(), "handleWebhook",
+		trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
 	// b, _ := ioutil.ReadAll(r.Body)
 	// fmt.Print(string(b))
 	// return
@@ -18,28 +35,46 @@ func handleWebhook(w http.ResponseWriter, r *http.Request) {
 		log.Error().
 			Err(err).
 			Msg("couldn't decode card webhook")
+		endSpan(span, err)
+		finishWork()
 		return
 	}
 
-	go resetAction(wh)
+	span.SetAttributes(
+		attribute.String("correlation", wh.Action.Id),
+		attribute.String("action.type", wh.Action.Type),
+		attribute.String("board", wh.Action.Data.Board.Id),
+	)
+	webhooksReceived.WithLabelValues(metricActionType(wh.Action.Type)).Inc()
+
+	go resetAction(ctx, wh)
 }
 
-func resetAction(wh Webhook) {
+func resetAction(ctx context.Context, wh Webhook) {
+	defer finishWork()
+	resetsInFlight.Inc()
+	defer resetsInFlight.Dec()
+
+	ctx, span := tracer.Start(ctx, "resetAction")
+	defer span.End()
+
 	cardId := wh.Action.Data.Card.Id
 	boardId := wh.Action.Data.Board.Id
 	userId := wh.Action.MemberCreator.Id
 
-	logger := log.With().Timestamp().
+	logger := log.With().
+		Str("correlation", wh.Action.Id).
 		Str("card", cardId).
 		Str("board", boardId).
 		Str("user", userId).
 		Str("wh", wh.Action.Type).
 		Logger()
+	ctx = context.WithValue(ctx, LOGGERKEY, logger)
 
 	// check if card is enabled
-	var token string
-	err = pg.Get(&token, `
-SELECT token FROM boards
+	var board Board
+	err = pg.Get(&board, `
+SELECT id, token, settings FROM boards
 WHERE id = $1
     `, boardId)
 
@@ -48,13 +83,96 @@ WHERE id = $1
 		return
 	}
 
-	trello := makeTrelloClient(token)
+	for {
+		plaintoken, err := openToken(board.Token)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to decrypt board token")
+			return
+		}
+		trello := makeLoggedTrelloClient(ctx, logger, plaintoken)
+
+		// during freezes only admins can change anything
+		actionDate, err := time.Parse(TRELLODATEFORMAT, wh.Action.Date)
+		if err != nil {
+			actionDate = time.Now()
+		}
+		freeze, frozen := board.Settings.frozen(actionDate)
+
+		if frozen && !isBoardAdmin(ctx, trello, userId, boardId) {
+			logger.Info().Str("freeze", freeze).Msg("board is frozen")
+		} else if userAllowed(ctx, trello, wh, board.Settings) {
+			logger.Info().Msg("allowed")
+			resetOutcomes.WithLabelValues("allowed").Inc()
+			onAllowed(ctx, logger, board.Token, wh)
+			emitEvent(logger, board, wh, "allowed", nil)
+			return
+		}
 
-	if userAllowed(trello, userId, boardId, cardId) {
-		logger.Info().Msg("allowed")
-		onAllowed(logger, token, wh)
-	} else {
 		logger.Info().Msg("disallowed: resetting")
-		onUnallowed(logger, token, wh)
+		err = onUnallowed(ctx, logger, board.Token, wh)
+		if err == errUnhandledAction {
+			// nothing was reverted, so there's nothing to tell anyone
+			return
+		}
+		if !isUnauthorized(err) || !tokenLost(plaintoken, boardId) {
+			if err == nil {
+				resetOutcomes.WithLabelValues("reverted").Inc()
+			} else {
+				countResetFailure(err)
+			}
+			afterReset(logger, board, wh, freeze, err)
+			return
+		}
+
+		// this token was revoked or lost access to the board,
+		// try again with the next one
+		board.Token, err = failoverToken(boardId, board.Token)
+		if err == sql.ErrNoRows {
+			logger.Warn().Msg("no valid tokens left")
+			countResetFailure(trelloError{Status: 401})
+			err = degradeBoard(boardId)
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed to flag board as degraded")
+			}
+			return
+		} else if err != nil {
+			logger.Error().Err(err).Msg("failed to fail over to another token")
+			return
+		}
+		logger.Info().Msg("trying again with another token")
+	}
+}
+
+// afterReset keeps a record of the reset and does everything else the
+// board settings ask for when a change is reverted.
+func afterReset(logger zerolog.Logger, board Board, wh Webhook, freeze string, reseterr error) {
+	err := recordRevert(board.Id, wh, reseterr, board.Settings.Notify != "")
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to record revert")
+	}
+
+	emitEvent(logger, board, wh, "reverted", reseterr)
+
+	// failed reverts are the ones admins most need to hear about
+	if board.Settings.Notify == "immediately" {
+		err = sendRevertsDigest(board.Id)
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to notify admins")
+		}
+	}
+
+	if reseterr != nil {
+		return
+	}
+
+	if board.Settings.ExplainReverts && wh.Action.Data.Card.Id != "" {
+		explainRevert(logger, board.Token, wh, whoIsAllowed(board.Settings, wh, freeze))
+	}
+
+	if board.Settings.Approvals && replayableActions[wh.Action.Type] {
+		err = requestApproval(board.Id, wh)
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to request approval")
+		}
 	}
 }